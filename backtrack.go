@@ -0,0 +1,160 @@
+package sre2
+
+// Describes a bounded backtracker, used by MatchIndex (and its variants) for
+// small programs and short inputs. It explores the program depth-first, in
+// priority order, so the first iMatch it reaches is the leftmost-first match.
+// Each pair of instr and input position is visited at most once, as recorded
+// in a bitmap: a pair which has already been visited has already failed to
+// match. This keeps the run linear in the size of the bitmap, which is why it
+// is only used while that is small.
+
+import (
+	"sync"
+)
+
+// Limit, in bits, of the visited bitmap, i.e. of len(prog) times the number of
+// input positions. Larger runs use the NFA.
+const backtrackMaxBits = 256 * 1024
+
+// bitState holds the working state of a single backtracking run. These are
+// recycled through bitStatePool.
+type bitState struct {
+	begin   int // position at which the run began
+	visited []uint32
+	jobs    []job
+	capture []int
+}
+
+// job is a pending branch of the backtracker, or a capture to restore as the
+// backtracker returns past an iIndexCap.
+type job struct {
+	idx     int  // instr to resume at, or capture index to restore
+	pos     int  // position to resume at, or previous value of the capture
+	restore bool // whether this job restores a capture
+}
+
+var bitStatePool sync.Pool
+
+// Whether the backtracker may be used for a run from the current position of
+// parser.
+func (r *sregexp) backtrackable(parser *SafeReader) bool {
+	return parser.rr == nil && !r.longest && len(r.prog)*(parser.len()-parser.npos()+1) <= backtrackMaxBits
+}
+
+// Match from the current position of parser, as _run() does for submatches.
+func (r *sregexp) backtrack(parser *SafeReader, anchor anchorMode) (success bool, capture []int) {
+	b, _ := bitStatePool.Get().(*bitState)
+	if b == nil {
+		b = new(bitState)
+	}
+	defer bitStatePool.Put(b)
+
+	begin, end := parser.npos(), parser.len()
+	width := end - begin + 1
+	b.begin = begin
+	b.visited = clearSlice(b.visited, (len(r.prog)*width+31)/32)
+	b.capture = clearSlice(b.capture, r.caps<<1)
+	for i := range b.capture {
+		b.capture[i] = -1
+	}
+
+	if anchor != aNone {
+		return r.try(b, parser, r.anchor, begin, anchor)
+	} else if r.literal == nil {
+		return r.try(b, parser, r.start, begin, anchor)
+	}
+
+	// Try the 0th capture at each position where the literal prefix is found, in
+	// place of the prefix ".*?". Any pair visited by an earlier try has already
+	// failed, so the bitmap is shared between tries.
+	for from := begin; from <= end; {
+		pos := r.literal.index(parser, from)
+		if pos < 0 {
+			break
+		}
+		if success, capture = r.try(b, parser, r.anchor, pos, anchor); success {
+			return
+		}
+		from = pos + 1
+	}
+	return false, nil
+}
+
+// Backtrack from the given instr and position, within the run described by b.
+func (r *sregexp) try(b *bitState, parser *SafeReader, start int, at int, anchor anchorMode) (success bool, capture []int) {
+	begin, end := b.begin, parser.len()
+	width := end - begin + 1
+	b.jobs = append(b.jobs[:0], job{idx: start, pos: at})
+
+	for len(b.jobs) != 0 {
+		j := b.jobs[len(b.jobs)-1]
+		b.jobs = b.jobs[:len(b.jobs)-1]
+		if j.restore {
+			b.capture[j.idx] = j.pos
+			continue
+		}
+
+		idx, pos := j.idx, j.pos
+		for {
+			// Give up on any pair which has already been visited.
+			bit := idx*width + pos - begin
+			if b.visited[bit/32]&(1<<(bit%32)) != 0 {
+				break
+			}
+			b.visited[bit/32] |= 1 << (bit % 32)
+
+			i := r.prog[idx]
+			switch i.mode {
+			case iSplit:
+				b.jobs = append(b.jobs, job{idx: i.out1.idx, pos: pos})
+				idx = i.out.idx
+				continue
+			case iIndexCap:
+				b.jobs = append(b.jobs, job{idx: i.cid, pos: b.capture[i.cid], restore: true})
+				b.capture[i.cid] = pos
+				idx = i.out.idx
+				continue
+			case iBoundaryCase:
+				left, right := rune(-1), rune(-1)
+				if pos > 0 {
+					left, _ = parser.decodeLast(pos)
+				}
+				if pos < end {
+					right, _ = parser.decode(pos)
+				}
+				if i.matchBoundaryMode(left, right) {
+					idx = i.out.idx
+					continue
+				}
+			case iRuneClass:
+				if anchor == aBoth && idx == r.tail {
+					break // the match must end with the input
+				}
+				if pos < end {
+					ch, size := parser.decode(pos)
+					if i.match(ch) {
+						idx, pos = i.out.idx, pos+size
+						continue
+					}
+				}
+			case iMatch:
+				if anchor == aBoth && pos != end {
+					break // the match must end with the input
+				}
+				return true, append([]int(nil), b.capture...)
+			}
+			break
+		}
+	}
+	return false, nil
+}
+
+// Returns a zeroed slice of the given length, reusing s if it is large enough.
+func clearSlice[T uint32 | int](s []T, size int) []T {
+	if cap(s) < size {
+		return make([]T, size)
+	}
+	s = s[:size]
+	clear(s)
+	return s
+}
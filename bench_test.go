@@ -2,9 +2,8 @@ package sre2
 
 // Note: This file is pulled from Go's regexp package, with non-benchmark tests removed. This is
 // useful for comparison with the regexp baseline. Interestingly enough, because these tests all
-// work on very 'small' strings, we're actually slower in most cases.
-// TODO: Add a string prefix matcher (i.e. not as part of the regexp prog), as this seems to be
-// where regexp gets most of its speed gains.
+// work on very 'small' strings, we're actually slower in most cases. Regexps with a literal prefix
+// (e.g. BenchmarkLiteral) skip ahead to each position where it is found via strings.Index.
 
 import (
 	"strings"
@@ -65,17 +64,16 @@ func BenchmarkMatchClass_InRange(b *testing.B) {
 	}
 }
 
-/*
 func BenchmarkReplaceAll(b *testing.B) {
 	x := "abcdefghijklmnopqrstuvwxyz"
 	b.StopTimer()
 	re := MustParse("[cjrw]")
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		re.ReplaceAllString(x, "")
+		re.ReplaceAll(x, "")
 	}
 }
-*/
+
 func BenchmarkAnchoredLiteralShortNonMatch(b *testing.B) {
 	b.StopTimer()
 	x := "abcdefghijklmnopqrstuvwxyz"
@@ -124,3 +122,118 @@ func BenchmarkComplexRe(b *testing.B) {
 		re.Match("aba#hello")
 	}
 }
+
+func BenchmarkParseRepeat(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		MustParse("(complex(group|here)[a-z\\d]+){50}")
+	}
+}
+
+func BenchmarkMatchParallel(b *testing.B) {
+	b.StopTimer()
+	x := strings.Repeat("xxxx ", 20) + "abcd"
+	re := MustParse("[a-c]+d")
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !re.Match(x) {
+				println("no match!")
+				break
+			}
+		}
+	})
+}
+
+func BenchmarkMatchEarly(b *testing.B) {
+	b.StopTimer()
+	x := "token" + strings.Repeat("x", 1<<20)
+	re := MustParse("tok(en)")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if re.MatchIndex(x) == nil {
+			println("no match!")
+			break
+		}
+	}
+}
+
+func BenchmarkFullMatch(b *testing.B) {
+	b.StopTimer()
+	x := strings.Repeat("abc", 20)
+	re := MustParse("(abc)+")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if !re.FullMatch(x) {
+			println("no match!")
+			break
+		}
+	}
+}
+
+func BenchmarkOnepass(b *testing.B) {
+	b.StopTimer()
+	x := strings.Repeat("1", 100) + "-" + strings.Repeat("2", 100)
+	re := MustParse("^(\\d+)-(\\d+)$")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if re.MatchIndex(x) == nil {
+			println("no match!")
+			break
+		}
+	}
+}
+
+func BenchmarkComplexReIndex(b *testing.B) {
+	b.StopTimer()
+	re := MustParse(".*(a|(b))+(#*).+")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		re.MatchIndex("aba#hello")
+	}
+}
+
+func BenchmarkMatchIndexLong(b *testing.B) {
+	b.StopTimer()
+	x := strings.Repeat("x", 1<<16) + "a=bc;"
+	re := MustParse("(\\w)=(b|c)+;")
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if re.MatchIndex(x) == nil {
+			println("no match!")
+			break
+		}
+	}
+}
+
+func BenchmarkRequiredLiteral(b *testing.B) {
+	b.StopTimer()
+	lines := strings.Split(strings.Repeat("INFO request served in 12ms\n", 999)+"ERROR mail to bob@example.com", "\n")
+	re := MustParse("\\w+@example\\.com")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		for _, line := range lines {
+			if re.Match(line) {
+				count++
+			}
+		}
+		if count != 1 {
+			println("no match!")
+			break
+		}
+	}
+}
+
+func BenchmarkMatchClassHeavy(b *testing.B) {
+	b.StopTimer()
+	x := strings.Repeat("some.words-here and there ", 20) + "me@example.com"
+	re := MustParse("[\\w.-]+@[\\w.-]+")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if re.MatchIndex(x) == nil {
+			println("no match!")
+			break
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package sre2
+
+// Lowers a syntax tree, as produced by the syntax package, into the list of
+// instructions run by the matchers. The resulting program is always wrapped in
+// instructions equivalent to ".*?(" and ").*?", so that the regexp may match
+// anywhere within an input string, and so that the outermost pair of captures
+// describes the entire match.
+
+import (
+	"unicode"
+
+	"github.com/samthor/sre2/syntax"
+)
+
+// Transient compiler state, holding the regexp under construction.
+type compiler struct {
+	re      *sregexp
+	special unicode.SpecialCase // case folding for case-insensitive nodes, or nil
+}
+
+// Generate a new instruction struct for use in regexp. By default, the instr
+// will be of type 'iSplit'.
+func (p *compiler) instr() *instr {
+	pos := len(p.re.prog)
+	if pos == cap(p.re.prog) {
+		if pos == 0 {
+			panic("should not have cap of zero")
+		}
+		local := p.re.prog
+		p.re.prog = make([]*instr, pos, pos*2)
+		copy(p.re.prog, local)
+	}
+	p.re.prog = p.re.prog[0 : pos+1]
+	i := &instr{pos, iSplit, nil, nil, bNone, nil, -1, ""}
+	p.re.prog[pos] = i
+	return i
+}
+
+// Helper method to connect instr 'from' to instr 'out'.
+// TODO: Use safer connection helpers.
+func (p *compiler) out(from *instr, to *instr) {
+	if from.out == nil {
+		from.out = to
+	} else if from.mode == iSplit && from.out1 == nil {
+		from.out1 = to
+	} else {
+		panic("can't out")
+	}
+}
+
+// Lower any node into instructions. Returns the first and last instructions
+// generated; the last instruction will always have a free out.
+func (p *compiler) compile(n syntax.Node) (start *instr, end *instr) {
+	switch n := n.(type) {
+	case *syntax.Empty:
+		start = p.instr()
+		return start, start
+	case *syntax.Literal:
+		return p.literal(n)
+	case *syntax.Class:
+		start = p.instr()
+		start.mode = iRuneClass
+		ranges := classRanges(n, p.special)
+		if p.re.bytes {
+			ranges = byteRanges(ranges)
+		}
+		start.rc = newRuneClass(ranges)
+		return start, start
+	case *syntax.Concat:
+		return p.concat(n.Subs)
+	case *syntax.Alternate:
+		return p.alternate(n.Subs)
+	case *syntax.Capture:
+		return p.capture(n)
+	case *syntax.Repeat:
+		return p.repeat(n)
+	case *syntax.Assertion:
+		start = p.makeBoundaryInstr(assertModes[n.Kind])
+		return start, start
+	}
+	panic("unexpected node")
+}
+
+// Lower a literal into a chain of single-rune instructions.
+func (p *compiler) literal(n *syntax.Literal) (start *instr, end *instr) {
+	if len(n.Runes) == 0 {
+		start = p.instr()
+		return start, start
+	}
+	for _, r := range n.Runes {
+		i := p.instr()
+		i.mode = iRuneClass
+		ranges := []RuneRange{{r, r}}
+		if n.FoldCase {
+			ranges = foldRanges(ranges, p.special)
+		}
+		if p.re.bytes {
+			ranges = byteRanges(ranges)
+		}
+		i.rc = newRuneClass(ranges)
+		if start == nil {
+			start = i
+		} else {
+			p.out(end, i)
+		}
+		end = i
+	}
+	return start, end
+}
+
+// Lower a sequence of nodes, each of which must match in turn.
+func (p *compiler) concat(subs []syntax.Node) (start *instr, end *instr) {
+	start = p.instr()
+	curr := start
+
+	for _, sub := range subs {
+		s, e := p.compile(sub)
+		p.out(curr, s)
+		curr = e
+	}
+
+	end = p.instr()
+	p.out(curr, end)
+	return start, end
+}
+
+// Lower some alternate nodes. Earlier alternatives are preferred, as they are
+// placed in the out (rather than out1) of each iSplit.
+func (p *compiler) alternate(subs []syntax.Node) (start *instr, end *instr) {
+	end = p.instr() // shared end state for alt
+
+	b_start, b_end := p.compile(subs[0])
+	start = b_start
+	p.out(b_end, end)
+
+	for _, sub := range subs[1:] {
+		start = p.instr()
+		p.out(start, b_start)
+
+		b_start, b_end = p.compile(sub)
+		p.out(start, b_start)
+		p.out(b_end, end)
+		b_start = start
+	}
+
+	return start, end
+}
+
+// Lower a capturing group, bracketing it with a pair of iIndexCap instructions.
+func (p *compiler) capture(n *syntax.Capture) (start *instr, end *instr) {
+	start = p.instr()
+	start.mode = iIndexCap
+	start.cid = n.Index * 2
+	start.cname = n.Name
+
+	end = p.instr()
+	end.mode = iIndexCap
+	end.cid = start.cid + 1
+	end.cname = n.Name
+
+	s, e := p.compile(n.Sub)
+	p.out(start, s)
+	p.out(e, end)
+	return start, end
+}
+
+// Lower a repetition, expanding the required and optional copies of its term.
+func (p *compiler) repeat(n *syntax.Repeat) (start *instr, end *instr) {
+	// Req and opt represent the number of required cases, and the number of
+	// optional cases, respectively. Opt may be -1 to indicate no optional limit.
+	req, opt := n.Min, -1
+	if n.Max != -1 {
+		opt = n.Max - n.Min
+	}
+
+	start = p.instr()
+	end = start
+
+	// Compile the term just once. Any further copies that are required are
+	// cloned from it before it is wired into the program, so that they share
+	// both its capture ids and its rune classes.
+	copies := req
+	if opt != -1 {
+		copies += opt
+	} else if req == 0 {
+		copies = 1
+	}
+	from := len(p.re.prog)
+	t_start, t_end := p.compile(n.Sub)
+	to := len(p.re.prog)
+	frags := make([][2]*instr, copies)
+	frags[0] = [2]*instr{t_start, t_end}
+	for i := 1; i < copies; i++ {
+		frags[i][0], frags[i][1] = p.clone(from, to, t_start, t_end)
+	}
+	next := func() {
+		t_start, t_end = frags[0][0], frags[0][1]
+		frags = frags[1:]
+	}
+
+	// Generate all required steps.
+	for i := 0; i < req; i++ {
+		next()
+		p.out(end, t_start)
+		end = t_end
+	}
+
+	// Generate all optional steps.
+	if opt == -1 && req == 0 && empty(frags[0][0], frags[0][1], make(map[*instr]bool)) {
+		// As the term may match empty, repeat it as per "(x+)?" rather than "x*", so
+		// that it is entered once before addstate() cuts its loop.
+		next()
+		helper := p.instr()
+		p.out(t_end, helper)
+		end = p.instr()
+		for _, split := range []*instr{start, helper} {
+			if n.Greedy {
+				split.out, split.out1 = t_start, end
+			} else {
+				split.out, split.out1 = end, t_start
+			}
+		}
+	} else if opt == -1 {
+		helper := p.instr()
+		p.out(end, helper)
+		if n.Greedy {
+			helper.out = t_start // greedily choose optional step
+		} else {
+			helper.out1 = t_start // optional step is 2nd preference
+		}
+		if end != t_end {
+			// This is a little kludgy, but basically only wires up the term to the
+			// helper iff it hasn't already been done.
+			p.out(t_end, helper)
+		}
+		end = helper
+	} else {
+		real_end := p.instr()
+
+		for i := 0; i < opt; i++ {
+			next()
+
+			helper := p.instr()
+			p.out(end, helper)
+			if n.Greedy {
+				helper.out = t_start // greedily choose optional step
+			} else {
+				helper.out1 = t_start // optional step is 2nd preference
+			}
+			p.out(helper, real_end)
+
+			end = p.instr()
+			p.out(t_end, end)
+		}
+
+		p.out(end, real_end)
+		end = real_end
+	}
+
+	return start, end
+}
+
+// Whether the fragment of instructions from start may reach end without
+// consuming a rune. The fragment must not yet be wired to any other instructions.
+func empty(start *instr, end *instr, seen map[*instr]bool) bool {
+	if start == nil || seen[start] || start.mode == iRuneClass {
+		return false
+	} else if start == end {
+		return true
+	}
+	seen[start] = true
+	switch start.mode {
+	case iSplit:
+		return empty(start.out, end, seen) || empty(start.out1, end, seen)
+	case iIndexCap, iBoundaryCase:
+		return empty(start.out, end, seen)
+	}
+	return false
+}
+
+// Duplicate the fragment of instructions prog[from:to], as just generated by
+// compile(). The fragment must not yet be wired to any other instructions.
+// Returns the copies of the given start and end instructions.
+func (p *compiler) clone(from int, to int, start *instr, end *instr) (*instr, *instr) {
+	base := len(p.re.prog)
+	for _, orig := range p.re.prog[from:to] {
+		i := p.instr()
+		idx := i.idx
+		*i = *orig
+		i.idx = idx
+	}
+
+	remap := func(i *instr) *instr {
+		if i == nil {
+			return nil
+		}
+		return p.re.prog[i.idx-from+base]
+	}
+	for _, i := range p.re.prog[base:] {
+		i.out = remap(i.out)
+		i.out1 = remap(i.out1)
+	}
+	return remap(start), remap(end)
+}
+
+// Mapping from syntax assertions to their boundaryMode.
+var assertModes = map[syntax.AssertKind]boundaryMode{
+	syntax.BeginText:              bBeginText,
+	syntax.BeginLine:              bBeginLine,
+	syntax.EndText:                bEndText,
+	syntax.EndLine:                bEndLine,
+	syntax.WordBoundary:           bWordBoundary,
+	syntax.NotWordBoundary:        bNotWordBoundary,
+	syntax.UnicodeWordBoundary:    bUnicodeWordBoundary,
+	syntax.NotUnicodeWordBoundary: bNotUnicodeWordBoundary,
+}
+
+// Build a left-right matcher of the given mode.
+func (p *compiler) makeBoundaryInstr(mode boundaryMode) *instr {
+	instr := p.instr()
+	instr.mode = iBoundaryCase
+	instr.lr = mode
+	return instr
+}
+
+// Helper method that generates instructions, for this compiler, that would
+// match the normal input string ".*?". Returns instructions begin and final,
+// both which may be used in any way the caller likes.
+func (p *compiler) makeDotStarOpt() (begin *instr, final *instr) {
+	begin = p.instr()
+	final = p.instr()
+
+	choice := p.instr()
+	p.out(begin, choice)
+	p.out(choice, final)
+
+	r := p.instr()
+	r.mode = iRuneClass
+	r.rc = newRuneClass([]RuneRange{{0, unicode.MaxRune}})
+	p.out(choice, r)
+	p.out(r, choice)
+
+	return begin, final
+}
+
+// Whether every path from the given instr passes through bBeginText before it
+// reaches an iRuneClass or iMatch instr. Instrs already seen are not walked
+// again, as they add no further paths.
+func beginsText(st *instr, seen []bool) bool {
+	if seen[st.idx] {
+		return true
+	}
+	seen[st.idx] = true
+	switch st.mode {
+	case iSplit:
+		return beginsText(st.out, seen) && beginsText(st.out1, seen)
+	case iIndexCap:
+		return beginsText(st.out, seen)
+	case iBoundaryCase:
+		return st.lr == bBeginText || beginsText(st.out, seen)
+	}
+	return false
+}
+
+// Find the runes matched by a single item within a class, as sorted and merged
+// ranges. If fold is set, the item is case-insensitive, folding case as per
+// foldOrbit with the given SpecialCase.
+func itemRanges(item syntax.ClassItem, fold bool, special unicode.SpecialCase) (ranges []RuneRange) {
+	switch item.Kind {
+	case syntax.ItemRange:
+		ranges = []RuneRange{{item.Lo, item.Hi}}
+	case syntax.ItemAnyNotNL:
+		ranges = []RuneRange{{0, '\n' - 1}, {'\n' + 1, unicode.MaxRune}}
+	case syntax.ItemAnyNL:
+		ranges = []RuneRange{{0, unicode.MaxRune}}
+	case syntax.ItemAnyByte:
+		ranges = []RuneRange{{0, 0xff}}
+	default:
+		ranges = tableRanges(item.Tables())
+	}
+
+	// Fold case before negation, so that e.g. "(?i)\PL" matches no letters.
+	if fold {
+		ranges = foldRanges(ranges, special)
+	}
+	if item.Negate {
+		return negateRanges(ranges)
+	}
+	return ranges
+}
+
+// Find the runes matched by an entire class, merging all of its items, as
+// sorted and merged ranges.
+func classRanges(class *syntax.Class, special unicode.SpecialCase) []RuneRange {
+	var ranges []RuneRange
+	for _, item := range class.Items {
+		ranges = append(ranges, itemRanges(item, class.FoldCase, special)...)
+	}
+	ranges = mergeRanges(ranges)
+
+	// As each item is closed under case folding, so is its negation.
+	if class.Negate {
+		return negateRanges(ranges)
+	}
+	return ranges
+}
+
+// Lower the given syntax tree into a complete regexp. Case-insensitive nodes
+// fold case as per foldOrbit with the given SpecialCase, which may be nil. If
+// bytes is set, the regexp matches bytes rather than runes, as per ParseBytes.
+func compile(node syntax.Node, special unicode.SpecialCase, bytes bool) *sregexp {
+	p := compiler{&sregexp{prog: make([]*instr, 0, 1), start: -1, anchor: -1, head: -1, tail: -1, caps: 1, bytes: bytes}, special}
+
+	// Count the capturing groups within the tree.
+	syntax.Walk(node, func(n syntax.Node) bool {
+		if c, ok := n.(*syntax.Capture); ok && c.Index >= p.re.caps {
+			p.re.caps = c.Index + 1
+		}
+		return true
+	})
+
+	// generate the prefix, ala ".*?("
+	// note that this has to come first, since it represents instruction zero
+	_, prefix := p.makeDotStarOpt()
+	prefix.mode = iIndexCap
+	prefix.cid = 0
+
+	// generate the suffix, ala ").*?" (followed by match)
+	suffix, match := p.makeDotStarOpt()
+	suffix.mode = iIndexCap
+	suffix.cid = 1
+	match.mode = iMatch
+
+	// lower the tree, placing it between prefix/suffix.
+	re_start, re_end := p.compile(node)
+	p.out(prefix, re_start)
+	p.out(re_end, suffix)
+
+	// cleanup and return success; note the anchored entry point and the loops
+	// of the prefix and suffix, which are never removed by cleanup.
+	head := p.re.prog[0].out.out1
+	tail := suffix.out.out1
+	p.re.prog = cleanup(p.re.prog)
+
+	if p.re.prog[0].out1 == nil {
+		p.re.start = p.re.prog[0].out.idx
+	}
+	p.re.anchor = prefix.idx
+	p.re.head = head.idx
+	p.re.tail = tail.idx
+	p.re.begin = beginsText(p.re.prog[p.re.anchor], make([]bool, len(p.re.prog)))
+
+	// Record the names of the capturing groups.
+	p.re.names = make([]string, p.re.caps)
+	for _, i := range p.re.prog {
+		if i.mode == iIndexCap {
+			p.re.names[i.cid>>1] = i.cname
+		}
+	}
+
+	p.re.literal = newLiteral(node, special, bytes)
+	p.re.required = newRequired(node, bytes)
+	p.re.lines = !spansLines(node, special)
+	p.re.dfa = newDFA(p.re)
+	p.re.onepass = newOnepass(p.re)
+
+	return p.re
+}
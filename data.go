@@ -1,77 +1,215 @@
 package sre2
 
 import (
+	"fmt"
+	"slices"
+	"sort"
 	"unicode"
+	"unicode/utf8"
 )
 
-// RuneFilter is a unique method signature for matching true/false over a given
-// unicode rune.
-type RuneFilter func(r rune) bool
+// RuneRange describes the runes from Lo to Hi, inclusive.
+type RuneRange struct {
+	Lo, Hi rune
+}
+
+// runeClass is a set of runes, held as sorted and merged ranges. Runes below
+// 128 are instead held in a bitmap, so that ASCII input avoids any search.
+type runeClass struct {
+	ascii  [2]uint64
+	ranges []RuneRange // ranges above the ASCII runes
+}
 
-// Generate a RuneFilter matching a single rune.
-func matchRune(to_match rune) RuneFilter {
-	return func(r rune) bool {
-		return r == to_match
+// Build a runeClass from the given ranges, which need not be sorted or merged.
+func newRuneClass(ranges []RuneRange) *runeClass {
+	c := &runeClass{}
+	for _, rr := range mergeRanges(ranges) {
+		for r := rr.Lo; r <= rr.Hi && r < utf8.RuneSelf; r++ {
+			c.ascii[r>>6] |= 1 << (r & 63)
+		}
+		if rr.Hi >= utf8.RuneSelf {
+			c.ranges = append(c.ranges, RuneRange{max(rr.Lo, utf8.RuneSelf), rr.Hi})
+		}
 	}
+	return c
 }
 
-// Generate a RuneFilter matching a range of runes, assumes from <= to.
-func matchRuneRange(from rune, to rune) RuneFilter {
-	return func(r rune) bool {
-		return r >= from && r <= to
+// Whether r is within this runeClass.
+func (c *runeClass) match(r rune) bool {
+	if r < utf8.RuneSelf {
+		return r >= 0 && c.ascii[r>>6]&(1<<(r&63)) != 0
+	}
+	ranges := c.ranges
+	for len(ranges) != 0 {
+		mid := len(ranges) / 2
+		if rr := ranges[mid]; r < rr.Lo {
+			ranges = ranges[:mid]
+		} else if r > rr.Hi {
+			ranges = ranges[mid+1:]
+		} else {
+			return true
+		}
 	}
+	return false
 }
 
-// Generate a RuneFilter matching a valid Unicode class. If no matching classes
-// are found, then this method will return nil.
-// Note that if just a single character is given, Categories will be searched
-// for this as a prefix (so that 'N' will match 'Nd', 'Nl', 'No' etc).
-func matchUnicodeClass(class string) RuneFilter {
-	found := false
-	match := make([]*unicode.RangeTable, 0)
-	if len(class) == 1 {
-		// A single character is a shorthand request for any category starting with this.
-		for key, r := range unicode.Categories {
-			if key[0] == class[0] {
-				found = true
-				match = append(match, r)
-			}
+// Whether any rune is within both this runeClass and o.
+func (c *runeClass) intersects(o *runeClass) bool {
+	if c.ascii[0]&o.ascii[0] != 0 || c.ascii[1]&o.ascii[1] != 0 {
+		return true
+	}
+	a, b := c.ranges, o.ranges
+	for len(a) != 0 && len(b) != 0 {
+		if a[0].Hi < b[0].Lo {
+			a = a[1:]
+		} else if b[0].Hi < a[0].Lo {
+			b = b[1:]
+		} else {
+			return true
 		}
-	} else {
-		// Search for the unicode class name inside cats/props/scripts.
-		options := []map[string]*unicode.RangeTable{
-			unicode.Categories, unicode.Properties, unicode.Scripts}
-		for _, option := range options {
-			if r, ok := option[class]; ok {
-				found = true
-				match = append(match, r)
-			}
+	}
+	return false
+}
+
+// Describes the runes of this runeClass, as sorted and merged ranges.
+func (c *runeClass) String() string {
+	var ranges []RuneRange
+	for r := rune(0); r < utf8.RuneSelf; r++ {
+		if c.match(r) {
+			ranges = append(ranges, RuneRange{r, r})
+		}
+	}
+	return fmt.Sprint(mergeRanges(append(ranges, c.ranges...)))
+}
+
+// Sort the given ranges, merging any which overlap or are adjacent. The ranges
+// are modified in place.
+func mergeRanges(ranges []RuneRange) []RuneRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lo < ranges[j].Lo })
+	out := ranges[:0]
+	for _, rr := range ranges {
+		if n := len(out); n != 0 && rr.Lo <= out[n-1].Hi+1 {
+			out[n-1].Hi = max(out[n-1].Hi, rr.Hi)
+		} else {
+			out = append(out, rr)
+		}
+	}
+	return slices.Clip(out)
+}
+
+// Find the runes not within the given sorted and merged ranges.
+func negateRanges(ranges []RuneRange) (out []RuneRange) {
+	next := rune(0)
+	for _, rr := range ranges {
+		if rr.Lo > next {
+			out = append(out, RuneRange{next, rr.Lo - 1})
+		}
+		next = rr.Hi + 1
+	}
+	if next <= unicode.MaxRune {
+		out = append(out, RuneRange{next, unicode.MaxRune})
+	}
+	return out
+}
+
+// Clip the given sorted and merged ranges to the runes which denote bytes, i.e.
+// those up to '\xff', as per ParseBytes.
+func byteRanges(ranges []RuneRange) (out []RuneRange) {
+	for _, rr := range ranges {
+		if rr.Lo <= 0xff {
+			out = append(out, RuneRange{rr.Lo, min(rr.Hi, 0xff)})
+		}
+	}
+	return out
+}
+
+// Find the runes within any of the given Unicode tables, as sorted and merged
+// ranges.
+func tableRanges(tables []*unicode.RangeTable) (out []RuneRange) {
+	for _, table := range tables {
+		for _, r := range table.R16 {
+			out = appendStride(out, rune(r.Lo), rune(r.Hi), rune(r.Stride))
 		}
+		for _, r := range table.R32 {
+			out = appendStride(out, rune(r.Lo), rune(r.Hi), rune(r.Stride))
+		}
+	}
+	return mergeRanges(out)
+}
+
+// Append the runes from lo to hi, stepping by stride, as ranges.
+func appendStride(out []RuneRange, lo rune, hi rune, stride rune) []RuneRange {
+	if stride == 1 {
+		return append(out, RuneRange{lo, hi})
+	}
+	for r := lo; r <= hi; r += stride {
+		out = append(out, RuneRange{r, r})
 	}
+	return out
+}
 
-	if found {
-		return func(r rune) bool {
-			for _, table := range match {
-				if unicode.Is(table, r) {
-					return true
-				}
+// Runes outside of these bounds are alone within their case folding orbit.
+const (
+	minFold = 0x0041
+	maxFold = 0x1e943
+)
+
+// Find the case folding orbit of r, per unicode.SimpleFold, including r itself.
+// If special is non-nil, runes within its ranges instead fold only to the runes
+// which it maps them to, or from, e.g. "i" to "İ" for unicode.TurkishCase.
+func foldOrbit(r rune, special unicode.SpecialCase) []rune {
+	orbit := []rune{r}
+	if !inSpecialCase(r, special) {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if !inSpecialCase(f, special) {
+				orbit = append(orbit, f)
+			}
+		}
+		return orbit
+	}
+	for i := 0; i < len(orbit); i++ {
+		f := orbit[i]
+		for _, m := range []rune{special.ToUpper(f), special.ToLower(f), special.ToTitle(f)} {
+			if !slices.Contains(orbit, m) {
+				orbit = append(orbit, m)
 			}
-			return false
 		}
 	}
-	return nil
+	return orbit
 }
 
-// Generate and return a new, inverse RuneFilter from the argument.
-func (rf RuneFilter) not() RuneFilter {
-	return func(r rune) bool {
-		return !rf(r)
+// Whether r is within the ranges of the given SpecialCase, which may be nil.
+func inSpecialCase(r rune, special unicode.SpecialCase) bool {
+	for _, cr := range special {
+		if r >= rune(cr.Lo) && r <= rune(cr.Hi) {
+			return true
+		}
 	}
+	return false
 }
 
-// Generate and return a new RuneFilter, which ignores case, from the argument.
-func (rf RuneFilter) ignoreCase() RuneFilter {
-	return func(r rune) bool {
-		return rf(unicode.ToLower(r)) || rf(unicode.ToUpper(r))
+// Expand the given sorted and merged ranges to include the case folding orbit,
+// per foldOrbit, of each rune within them.
+func foldRanges(ranges []RuneRange, special unicode.SpecialCase) []RuneRange {
+	out := slices.Clone(ranges)
+	add := func(r rune) {
+		for _, f := range foldOrbit(r, special)[1:] {
+			out = append(out, RuneRange{f, f})
+		}
+	}
+	for _, rr := range ranges {
+		if rr.Lo > minFold || rr.Hi < maxFold {
+			for r := max(rr.Lo, minFold); r <= min(rr.Hi, maxFold); r++ {
+				add(r)
+			}
+		}
+		// Any orbit is already within a range covering every SimpleFold orbit,
+		// but special may also fold runes to, or from, outside of it.
+		for _, cr := range special {
+			for r := max(rr.Lo, rune(cr.Lo)); r <= min(rr.Hi, rune(cr.Hi)); r++ {
+				add(r)
+			}
+		}
 	}
+	return mergeRanges(out)
 }
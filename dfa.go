@@ -0,0 +1,307 @@
+package sre2
+
+// Describes a lazily built DFA, used by Match (and its variants) when no
+// submatches are required. Each DFA state is the set of instructions held by a
+// stateList after addstate(): its transitions are computed from the NFA as they
+// are first needed, and then cached. As addstate() may look at the rune after
+// the one consumed (e.g. for '$' or '\b'), transitions are keyed both by the
+// consumed rune, and by the boundary class of the rune after it.
+//
+// Where the regexp may skip ahead, states which hold no thread that has begun
+// to match are marked as inactive. From these, the DFA skips ahead to the next
+// position at which a match may begin, rather than following the prefix ".*?"
+// over every rune: see skip().
+//
+// The cache is limited in size. If it fills up during a run, then it is reset,
+// and the remainder of that run is matched by the NFA instead. The cache is
+// shared by concurrent runs, which read its states and transitions without
+// locking: its mutex is only held while a state or transition is added.
+
+import (
+	"encoding/binary"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Default limit, in approximate bytes, of the states cached by each DFA.
+const dfaCacheLimit = 1 << 20
+
+// dfa holds the lazily built states of a regexp. The start and head states may
+// be read at any time; the remaining fields are guarded by mu.
+type dfa struct {
+	re    *sregexp
+	right bool // whether any boundary looks at the rune on its right
+	start [numBoundaryClasses]atomic.Pointer[dfaState]
+	head  atomic.Pointer[dfaState] // inactive state holding only the loop of the prefix ".*?"
+
+	mu     sync.Mutex
+	states map[string]*dfaState // states by key of their instructions
+	list   *stateList           // scratch space for computing states
+	size   int                  // approximate bytes used by the cache
+	limit  int                  // limit of size, at which the cache is reset
+}
+
+// dfaState is a single state of a dfa. Its transitions may be read at any time,
+// but are only added while holding the mutex of the dfa.
+type dfaState struct {
+	insts  []int // sorted indexes of the iRuneClass and iMatch instrs in this state
+	match  bool  // whether this state includes iMatch
+	active bool  // whether any thread in this state has begun to match
+
+	// Transitions by ASCII rune, if the right is ignored, and otherwise by key of
+	// the rune consumed and the boundary class of the rune after it.
+	ascii atomic.Pointer[[128]atomic.Pointer[dfaState]]
+	next  sync.Map
+}
+
+// Build an empty DFA for the given regexp.
+func newDFA(re *sregexp) *dfa {
+	d := &dfa{re: re, list: makeStateList(len(re.prog), nil), limit: dfaCacheLimit}
+	for _, i := range re.prog {
+		if i.mode == iBoundaryCase && i.lr != bBeginText && i.lr != bBeginLine {
+			d.right = true
+		}
+	}
+	d.reset()
+	return d
+}
+
+// Clear all cached states. Runs which still hold a cleared state may continue
+// to use it, and its transitions, until they finish.
+func (d *dfa) reset() {
+	d.states = make(map[string]*dfaState)
+	for c := range d.start {
+		d.start[c].Store(nil)
+	}
+	d.head.Store(nil)
+	d.size = 0
+}
+
+// Find the boundary class of the rune to the right of the cursor, or zero if
+// no boundary looks at it.
+func (d *dfa) class(right rune) byte {
+	if !d.right {
+		return 0
+	}
+	return boundaryClass(right)
+}
+
+// Build a SafeReader which has just consumed ch (or nothing, if ch is -1), and
+// which peeks at the representative rune of the boundary class c. If raw, runes
+// are read as bytes, as per SafeReader.
+func boundaryReader(ch rune, c byte, raw bool) SafeReader {
+	var b []byte
+	for _, r := range []rune{ch, boundaryRunes[c]} {
+		if r == -1 {
+			continue
+		} else if raw {
+			b = append(b, byte(r))
+		} else {
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	parser := NewSafeReaderBytes(b)
+	parser.raw = raw
+	if ch != -1 {
+		parser.nextCh()
+	}
+	return parser
+}
+
+// Collect the sorted instructions currently held by d.list.
+func (d *dfa) collect() []int {
+	insts := make([]int, len(d.list.states))
+	for k, st := range d.list.states {
+		insts[k] = st.idx
+	}
+	slices.Sort(insts)
+	d.list.clear()
+	return insts
+}
+
+// Find the cached state holding the given instructions, or create it. Returns
+// nil if the cache is full, in which case it is reset. Must hold the mutex.
+func (d *dfa) state(insts []int, active bool) *dfaState {
+	var key []byte
+	if active {
+		key = append(key, 1)
+	} else {
+		key = append(key, 0)
+	}
+	for _, idx := range insts {
+		key = binary.AppendUvarint(key, uint64(idx))
+	}
+	if s, ok := d.states[string(key)]; ok {
+		return s
+	}
+
+	cost := 64 + 8*len(insts) + 2*len(key)
+	if !d.grow(cost) {
+		return nil
+	}
+	s := &dfaState{insts: insts, active: active}
+	for _, idx := range insts {
+		if d.re.prog[idx].mode == iMatch {
+			s.match = true
+		}
+	}
+	d.states[string(key)] = s
+	return s
+}
+
+// Add cost to the size of the cache. If this would exceed its limit, then the
+// cache is reset instead, and this returns false. Must hold the mutex.
+func (d *dfa) grow(cost int) bool {
+	if d.size+cost > d.limit {
+		d.reset()
+		return false
+	}
+	d.size += cost
+	return true
+}
+
+// Find the start state, where the first rune is of the boundary class c.
+// Returns nil if the cache is full.
+func (d *dfa) startState(c byte) *dfaState {
+	if s := d.start[c].Load(); s != nil {
+		return s
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	parser := boundaryReader(-1, c, d.re.bytes)
+	d.list.addstate(&parser, d.re.prog[d.re.start], false, nil)
+	s := d.state(d.collect(), false)
+	if s != nil {
+		d.start[c].Store(s)
+	}
+	return s
+}
+
+// Find the inactive state holding only the loop of the prefix ".*?". Returns nil
+// if the cache is full.
+func (d *dfa) headState() *dfaState {
+	if s := d.head.Load(); s != nil {
+		return s
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.state([]int{d.re.head}, false)
+	if s != nil {
+		d.head.Store(s)
+	}
+	return s
+}
+
+// Find the state reached from s by consuming ch, where the rune after ch is of
+// the boundary class c. If the cache is full, returns nil, along with the
+// instructions of that state.
+func (d *dfa) next(s *dfaState, ch rune, c byte) (*dfaState, []int) {
+	ascii := !d.right && ch >= 0 && ch < 128
+	key := uint64(ch)<<8 | uint64(c)
+	if ascii {
+		if t := s.ascii.Load(); t != nil {
+			if ns := t[ch].Load(); ns != nil {
+				return ns, nil
+			}
+		}
+	} else if ns, ok := s.next.Load(key); ok {
+		return ns.(*dfaState), nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	parser := boundaryReader(ch, c, d.re.bytes)
+	active := false
+	for _, idx := range s.insts {
+		if i := d.re.prog[idx]; i.match(ch) {
+			d.list.addstate(&parser, i.out, false, nil)
+			active = active || (idx != d.re.head && d.re.skips())
+		}
+	}
+	insts := d.collect()
+	ns := d.state(insts, active)
+	if ns == nil {
+		return nil, insts
+	}
+
+	if ascii {
+		t := s.ascii.Load()
+		if t == nil {
+			if !d.grow(1024) {
+				return nil, insts
+			}
+			t = new([128]atomic.Pointer[dfaState])
+			s.ascii.Store(t)
+		}
+		t[ch].Store(ns)
+	} else {
+		if !d.grow(32) {
+			return nil, insts
+		}
+		s.next.Store(key, ns)
+	}
+	return ns, nil
+}
+
+// Run the DFA over the remaining input in parser, which must be at its start.
+// Returns whether the input matched.
+func (d *dfa) match(parser *SafeReader) bool {
+	s := d.startState(d.class(parser.peek()))
+	if s == nil {
+		return d.fallback(nil, parser, true)
+	}
+
+	var required skipState
+	until := -1
+	for !s.match {
+		if len(s.insts) == 0 {
+			return false // no more possible states, short-circuit failure
+		}
+		if !s.active && d.re.skips() && parser.rr == nil && parser.npos() > until {
+			pos := parser.npos()
+			next := d.re.skip(parser, pos, &required)
+			if next < 0 {
+				return false // no match may begin
+			}
+			if d.re.literal == nil {
+				until = required.next // no further skip is possible before this
+			}
+			if head := d.headState(); next > pos && head != nil {
+				// Skip ahead to the rune before this position, so that it is
+				// consumed by the loop of the prefix ".*?" alone.
+				_, size := parser.decodeLast(next)
+				parser.seek(next - size)
+				s = head
+			}
+		}
+		ch := parser.nextCh()
+		if ch == -1 {
+			return false
+		}
+		ns, insts := d.next(s, ch, d.class(parser.peek()))
+		if ns == nil {
+			// The cache was full, and has been reset. Match the remainder with the NFA.
+			return d.fallback(insts, parser, false)
+		}
+		s = ns
+	}
+	return true
+}
+
+// Match the remaining input in parser with the NFA, beginning with the given
+// instructions, or from the start of the regexp.
+func (d *dfa) fallback(insts []int, parser *SafeReader, start bool) bool {
+	curr := makeStateList(len(d.re.prog), nil)
+	next := makeStateList(len(d.re.prog), nil)
+	if start {
+		success, _ := d.re._run(curr, next, parser, false, aNone)
+		return success
+	}
+	for _, idx := range insts {
+		curr.put(idx, nil)
+	}
+	success, _ := d.re.resume(curr, next, parser, false, aNone)
+	return success
+}
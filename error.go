@@ -0,0 +1,34 @@
+package sre2
+
+// Re-exports the structured parse errors of the syntax package, so that callers
+// of Parse() need not import it directly.
+
+import (
+	"github.com/samthor/sre2/syntax"
+)
+
+// ParseError describes a failure to parse a regexp. See syntax.ParseError.
+type ParseError = syntax.ParseError
+
+// ErrorCode describes a class of failure encountered while parsing a regexp.
+// Each ErrorCode satisfies the error interface, for use with errors.Is.
+type ErrorCode = syntax.ErrorCode
+
+// Enum-style definitions for the ErrorCode type.
+const (
+	ErrInternalError         = syntax.ErrInternalError
+	ErrUnexpectedEOF         = syntax.ErrUnexpectedEOF
+	ErrMissingRepeatArgument = syntax.ErrMissingRepeatArgument
+	ErrUnexpectedClose       = syntax.ErrUnexpectedClose
+	ErrMissingParen          = syntax.ErrMissingParen
+	ErrMissingBracket        = syntax.ErrMissingBracket
+	ErrMissingDelimiter      = syntax.ErrMissingDelimiter
+	ErrInvalidEscape         = syntax.ErrInvalidEscape
+	ErrInvalidCharClass      = syntax.ErrInvalidCharClass
+	ErrInvalidCharRange      = syntax.ErrInvalidCharRange
+	ErrInvalidRepeatSize     = syntax.ErrInvalidRepeatSize
+	ErrInvalidFlag           = syntax.ErrInvalidFlag
+	ErrDuplicateName         = syntax.ErrDuplicateName
+	ErrInvalidByte           = syntax.ErrInvalidByte
+	ErrInvalidName           = syntax.ErrInvalidName
+)
@@ -0,0 +1,142 @@
+package sre2
+
+// Describes the search API of sre2: finding the leftmost-first match within a
+// string starting at any offset, and iterating over successive, non-overlapping
+// matches. As with all matchers, searches stop as soon as their result is
+// certain, rather than always consuming the entire input.
+
+import (
+	"iter"
+)
+
+// find searches the input for the leftmost-first match which begins at or after
+// the byte offset pos. Runes before pos are still visible to boundary matchers
+// such as '^' or '\b'. Returns the capture indexes of the match, or nil.
+func (r *sregexp) find(parser SafeReader, pos int) []int {
+	parser.seek(pos)
+	_, capture := r.run(parser, true, aNone)
+	return capture
+}
+
+// Find returns the text of the leftmost-first match within src. If there is no
+// match, returns the empty string; use FindIndex to distinguish this case from
+// an empty match.
+func (r *sregexp) Find(src string) string {
+	if m := r.find(r.reader(src), 0); m != nil {
+		return src[m[0]:m[1]]
+	}
+	return ""
+}
+
+// FindBytes is as Find, but returns a slice of b holding the match. If there is
+// no match, returns nil.
+func (r *sregexp) FindBytes(b []byte) []byte {
+	if m := r.find(r.readerBytes(b), 0); m != nil {
+		return b[m[0]:m[1]:m[1]]
+	}
+	return nil
+}
+
+// FindIndex returns the indexes of the leftmost-first match within src, in the
+// same form as MatchIndex: match n will be between (n*2,(n*2)+1). On failure,
+// will return nil.
+func (r *sregexp) FindIndex(src string) []int {
+	return r.find(r.reader(src), 0)
+}
+
+// FindIndexBytes is as FindIndex, but searches b.
+func (r *sregexp) FindIndexBytes(b []byte) []int {
+	return r.find(r.readerBytes(b), 0)
+}
+
+// Iterate over the successive, non-overlapping matches within the input. As with
+// RE2, an empty match directly after a previous match is ignored, and the search
+// resumes one rune past any empty match.
+func (r *sregexp) all(parser SafeReader) iter.Seq[[]int] {
+	return func(yield func([]int) bool) {
+		prev := -1 // end of the previous match
+		for pos := 0; pos <= parser.len(); {
+			m := r.find(parser, pos)
+			if m == nil {
+				return
+			}
+
+			accept := true
+			if m[1] == pos {
+				// We've found an empty match. Step over the next rune, so that the
+				// search always makes progress.
+				accept = m[0] != prev
+				size := 1 // at EOF
+				if pos < parser.len() {
+					_, size = parser.decode(pos)
+				}
+				pos += size
+			} else {
+				pos = m[1]
+			}
+			prev = m[1]
+
+			if accept && !yield(m) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the successive, non-overlapping matches within
+// src, each described as per FindIndex. As with RE2, an empty match directly
+// after a previous match is ignored, and the search resumes one rune past any
+// empty match.
+func (r *sregexp) All(src string) iter.Seq[[]int] {
+	return r.all(r.reader(src))
+}
+
+// AllBytes is as All, but iterates over the matches within b.
+func (r *sregexp) AllBytes(b []byte) iter.Seq[[]int] {
+	return r.all(r.readerBytes(b))
+}
+
+// Collect the indexes of up to n matches from the given iterator, or all of
+// them if n < 0.
+func collect(matches iter.Seq[[]int], n int) (ret [][]int) {
+	if n == 0 {
+		return nil
+	}
+	for m := range matches {
+		ret = append(ret, m)
+		if len(ret) == n {
+			break
+		}
+	}
+	return ret
+}
+
+// FindAllIndex returns the indexes of up to n successive, non-overlapping
+// matches within src, as per All. If n < 0, returns all matches. If there is no
+// match, returns nil.
+func (r *sregexp) FindAllIndex(src string, n int) [][]int {
+	return collect(r.All(src), n)
+}
+
+// FindAllIndexBytes is as FindAllIndex, but searches b.
+func (r *sregexp) FindAllIndexBytes(b []byte, n int) [][]int {
+	return collect(r.AllBytes(b), n)
+}
+
+// FindAll returns the text of up to n successive, non-overlapping matches
+// within src, as per All. If n < 0, returns all matches. If there is no match,
+// returns nil.
+func (r *sregexp) FindAll(src string, n int) (ret []string) {
+	for _, m := range r.FindAllIndex(src, n) {
+		ret = append(ret, src[m[0]:m[1]])
+	}
+	return ret
+}
+
+// FindAllBytes is as FindAll, but returns slices of b holding each match.
+func (r *sregexp) FindAllBytes(b []byte, n int) (ret [][]byte) {
+	for _, m := range r.FindAllIndexBytes(b, n) {
+		ret = append(ret, b[m[0]:m[1]:m[1]])
+	}
+	return ret
+}
@@ -0,0 +1,261 @@
+package sre2
+
+// Describes the literal prefix of a regexp: a string with which every match
+// must begin. Unanchored matches use this to find the positions at which a
+// match may begin via strings.Index (or IndexAny, for a case-insensitive
+// prefix), rather than following the prefix ".*?" over every rune.
+//
+// Also describes the required literal of a regexp: a string which every match
+// must contain, although not necessarily at its start. Input which lacks it is
+// rejected before any matcher runs. Where no match may span a newline, a match
+// must also lie within a line holding the literal, so unanchored matches skip
+// ahead to each such line.
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/samthor/sre2/syntax"
+)
+
+// literal is the required prefix of a regexp.
+type literal struct {
+	str  string // the prefix, or if fold, every rune which may begin it
+	b    []byte // str, for searching []byte input
+	fold bool   // whether the prefix is case-insensitive
+}
+
+// Build the literal prefix of the given syntax tree, folding case as per
+// foldOrbit with the given SpecialCase. If bytes is set, the prefix is of
+// bytes, as per ParseBytes. Returns nil if there is none.
+func newLiteral(node syntax.Node, special unicode.SpecialCase, bytes bool) *literal {
+	runes, fold, _ := literalPrefix(node)
+	if len(runes) == 0 {
+		return nil
+	}
+	for _, r := range runes {
+		if r == utf8.RuneError {
+			return nil // may match invalid UTF-8, which can't be searched for
+		}
+	}
+	if fold {
+		runes = foldOrbit(runes[0], special)
+	}
+	l := &literal{str: string(runes), fold: fold}
+	if bytes {
+		if fold {
+			// Runes above '\xff' never match, and IndexAny would read any runes
+			// above ASCII as UTF-8.
+			runes = slices.DeleteFunc(runes, func(r rune) bool { return r > 0xff })
+			if slices.Max(runes) >= utf8.RuneSelf {
+				return nil
+			}
+		}
+		l.str = latin1(runes)
+	}
+	l.b = []byte(l.str)
+	return l
+}
+
+// Find the runes with which every match of the given node must begin, and
+// whether these are case-insensitive. Also returns whether the runes describe
+// the entire node, such that any following node may extend them.
+func literalPrefix(n syntax.Node) (prefix []rune, fold bool, complete bool) {
+	switch n := n.(type) {
+	case *syntax.Empty, *syntax.Assertion:
+		return nil, false, true
+	case *syntax.Literal:
+		return n.Runes, n.FoldCase, true
+	case *syntax.Capture:
+		return literalPrefix(n.Sub)
+	case *syntax.Repeat:
+		if n.Min > 0 {
+			prefix, fold, complete = literalPrefix(n.Sub)
+			return prefix, fold, complete && n.Min == 1 && n.Max == 1
+		}
+	case *syntax.Concat:
+		for _, sub := range n.Subs {
+			p, f, c := literalPrefix(sub)
+			if len(p) != 0 {
+				if len(prefix) != 0 && f != fold {
+					return prefix, fold, false
+				}
+				prefix, fold = append(prefix[:len(prefix):len(prefix)], p...), f
+			}
+			if !c {
+				return prefix, fold, false
+			}
+		}
+		return prefix, fold, true
+	}
+	return nil, false, false
+}
+
+// Build the required literal of the given syntax tree. If bytes is set, the
+// literal is of bytes, as per ParseBytes. Returns nil if there is none.
+func newRequired(node syntax.Node, bytes bool) *literal {
+	info := literalInfo(node)
+	if len(info.inner) == 0 || strings.ContainsRune(info.inner, utf8.RuneError) {
+		return nil
+	}
+	if bytes {
+		info.inner = latin1([]rune(info.inner))
+	}
+	return &literal{str: info.inner, b: []byte(info.inner)}
+}
+
+// Encode the given runes, each of which must be at most '\xff', as one byte
+// each, as per ParseBytes.
+func latin1(runes []rune) string {
+	b := make([]byte, len(runes))
+	for i, r := range runes {
+		b[i] = byte(r)
+	}
+	return string(b)
+}
+
+// literalStrings describes the literal strings which every match of a node must
+// contain.
+type literalStrings struct {
+	exact  bool   // whether every match is exactly prefix (and thus suffix and inner)
+	prefix string // required at the start of every match
+	suffix string // required at the end of every match
+	inner  string // required anywhere within every match, the longest found
+}
+
+// Find the literal strings which every match of the given node must contain.
+// Case-insensitive literals are ignored.
+func literalInfo(n syntax.Node) (info literalStrings) {
+	switch n := n.(type) {
+	case *syntax.Empty, *syntax.Assertion:
+		info.exact = true
+	case *syntax.Literal:
+		if !n.FoldCase {
+			s := string(n.Runes)
+			info = literalStrings{true, s, s, s}
+		}
+	case *syntax.Capture:
+		info = literalInfo(n.Sub)
+	case *syntax.Repeat:
+		if n.Min > 0 {
+			info = literalInfo(n.Sub)
+			info.exact = info.exact && n.Min == 1 && n.Max == 1
+		}
+	case *syntax.Concat:
+		info.exact = true
+		for _, sub := range n.Subs {
+			next := literalInfo(sub)
+			inner := longest(info.inner, next.inner, info.suffix+next.prefix)
+			if info.exact {
+				info.prefix += next.prefix
+			}
+			if next.exact {
+				info.suffix += next.suffix
+			} else {
+				info.suffix = next.suffix
+			}
+			info.exact = info.exact && next.exact
+			info.inner = longest(inner, info.prefix, info.suffix)
+		}
+	}
+	return info
+}
+
+// Returns the longest of the given strings, preferring the first.
+func longest(strs ...string) (ret string) {
+	for _, s := range strs {
+		if len(s) > len(ret) {
+			ret = s
+		}
+	}
+	return ret
+}
+
+// Whether any match of the given node may contain a newline.
+func spansLines(node syntax.Node, special unicode.SpecialCase) (spans bool) {
+	syntax.Walk(node, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.Literal:
+			spans = spans || slices.Contains(n.Runes, '\n')
+		case *syntax.Class:
+			spans = spans || newRuneClass(classRanges(n, special)).match('\n')
+		}
+		return !spans
+	})
+	return spans
+}
+
+// skipState caches the position of the required literal between calls to
+// skip(). It should initially be zero.
+type skipState struct {
+	found bool
+	next  int // first occurrence of the required literal, or -1 if none
+	start int // start of the line holding next, or where it was searched from
+}
+
+// Find the first position at or after pos, within the input of parser, at
+// which an unanchored match may begin. Returns -1 if there is none.
+func (r *sregexp) skip(parser *SafeReader, pos int, st *skipState) int {
+	if r.literal != nil {
+		return r.literal.index(parser, pos)
+	}
+	if !st.found || (st.next >= 0 && st.next < pos) {
+		st.found, st.next = true, r.required.index(parser, pos)
+		if st.next >= 0 {
+			// The match must lie within the line holding the required literal.
+			// As it must also begin at or after pos, look no further back.
+			if parser.b != nil {
+				st.start = pos + bytes.LastIndexByte(parser.b[pos:st.next], '\n') + 1
+			} else {
+				st.start = pos + strings.LastIndexByte(parser.str[pos:st.next], '\n') + 1
+			}
+		}
+	}
+	if st.next < 0 {
+		return -1
+	}
+	return max(pos, st.start)
+}
+
+// Whether unanchored matches may skip ahead via skip().
+func (r *sregexp) skips() bool {
+	return r.literal != nil || (r.required != nil && r.lines)
+}
+
+// Find the first position at or after from, within the input of parser, at
+// which a match may begin. Returns -1 if there is none.
+func (l *literal) index(parser *SafeReader, from int) int {
+	var i int
+	switch {
+	case parser.b != nil && l.fold:
+		i = bytes.IndexAny(parser.b[from:], l.str)
+	case parser.b != nil:
+		i = bytes.Index(parser.b[from:], l.b)
+	case l.fold:
+		i = strings.IndexAny(parser.str[from:], l.str)
+	default:
+		i = strings.Index(parser.str[from:], l.str)
+	}
+	if i < 0 {
+		return -1
+	}
+	return from + i
+}
+
+// Whether a match may begin at the given position, within the input of parser.
+func (l *literal) at(parser *SafeReader, pos int) bool {
+	if l.fold {
+		if pos >= parser.len() {
+			return false
+		}
+		r, _ := parser.decode(pos)
+		return strings.ContainsRune(l.str, r)
+	}
+	if parser.b != nil {
+		return bytes.HasPrefix(parser.b[pos:], l.b)
+	}
+	return strings.HasPrefix(parser.str[pos:], l.str)
+}
@@ -0,0 +1,165 @@
+package sre2
+
+// Describes a one-pass matcher, used by MatchIndex (and its variants) for
+// anchored matches. Where at most one branch of a regexp may match the next
+// rune at each position, a match needs only a single thread, and so captures
+// may be recorded in a single fixed array rather than one for each state.
+//
+// The compiler prepares, for the anchor and for the instruction after each
+// iRuneClass, the ordered paths through any iSplit, iIndexCap and
+// iBoundaryCase instrs to the next iRuneClass (or to the end of the match).
+// The regexp is one-pass if, from each instr, the paths to different iRuneClass
+// instrs match disjoint runes; otherwise no matcher is built. Boundaries along
+// these paths are not considered, so some unambiguous regexps, such as
+// "^\w+\b.", are not treated as one-pass.
+
+// Limits on the paths prepared from a single instr. Regexps which exceed these
+// are not matched by the one-pass matcher.
+const (
+	onepassMaxEdges = 64
+	onepassMaxSteps = 256
+)
+
+// onepass holds the prepared paths of a regexp.
+type onepass struct {
+	re    *sregexp
+	edges [][]onepassEdge // paths from each instr, by index
+}
+
+// onepassEdge is a path from an instr to an iRuneClass, or to the end of the
+// match (the close of the 0th capture).
+type onepassEdge struct {
+	target int      // index of the iRuneClass instr, or -1 for the end
+	caps   []int    // captures set along this path, in order
+	conds  []*instr // iBoundaryCase instrs along this path
+}
+
+// Prepare the one-pass matcher for the given regexp. Returns nil if the regexp
+// is not one-pass, or if its paths exceed the limits above.
+func newOnepass(re *sregexp) *onepass {
+	o := &onepass{re: re, edges: make([][]onepassEdge, len(re.prog))}
+	pending := []int{re.anchor}
+	for len(pending) != 0 {
+		from := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if o.edges[from] != nil {
+			continue
+		}
+
+		steps := 0
+		edges := make([]onepassEdge, 0)
+		if !o.walk(re.prog[from], nil, nil, &edges, &steps) || !o.unambiguous(edges) {
+			return nil
+		}
+		o.edges[from] = edges
+		for _, e := range edges {
+			if e.target != -1 {
+				pending = append(pending, re.prog[e.target].out.idx)
+			}
+		}
+	}
+	return o
+}
+
+// Descend from the given instr in priority order, as addstate() does, adding
+// each path found to edges. Returns false if the limits are exceeded.
+func (o *onepass) walk(st *instr, caps []int, conds []*instr, edges *[]onepassEdge, steps *int) bool {
+	*steps++
+	if *steps > onepassMaxSteps || len(*edges) >= onepassMaxEdges {
+		return false
+	}
+	switch st.mode {
+	case iSplit:
+		return o.walk(st.out, caps, conds, edges, steps) && o.walk(st.out1, caps, conds, edges, steps)
+	case iIndexCap:
+		caps = append(caps[:len(caps):len(caps)], st.cid)
+		if st.cid == 1 {
+			*edges = append(*edges, onepassEdge{-1, caps, conds})
+			return true
+		}
+		return o.walk(st.out, caps, conds, edges, steps)
+	case iBoundaryCase:
+		conds = append(conds[:len(conds):len(conds)], st)
+		return o.walk(st.out, caps, conds, edges, steps)
+	case iRuneClass:
+		*edges = append(*edges, onepassEdge{st.idx, caps, conds})
+		return true
+	}
+	return false // iMatch is only found after the end of the match
+}
+
+// Whether at most one of the given paths, to different iRuneClass instrs, may
+// match any rune.
+func (o *onepass) unambiguous(edges []onepassEdge) bool {
+	for i, e := range edges {
+		for _, f := range edges[i+1:] {
+			if e.target == -1 || f.target == -1 || e.target == f.target {
+				continue
+			}
+			if o.re.prog[e.target].rc.intersects(o.re.prog[f.target].rc) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Whether each iBoundaryCase along this path matches between left and right.
+func (e *onepassEdge) holds(left rune, right rune) bool {
+	for _, c := range e.conds {
+		if !c.matchBoundaryMode(left, right) {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the captures along this path at the given position.
+func (e *onepassEdge) set(capture []int, pos int) {
+	for _, c := range e.caps {
+		capture[c] = pos
+	}
+}
+
+// Whether the one-pass matcher may be used for a run with the given anchor.
+func (o *onepass) usable(parser *SafeReader, anchor anchorMode) bool {
+	return o != nil && parser.rr == nil && !o.re.longest && (anchor != aNone || o.re.begin)
+}
+
+// Match from the current position of parser, which is treated as anchored at
+// the start.
+func (o *onepass) run(parser *SafeReader, anchor anchorMode, slots *slotPool) (success bool, capture []int) {
+	curr := slots.blank()
+	defer slots.put(curr)
+
+	from := o.re.anchor
+	for {
+		left, ch := parser.curr(), parser.peek()
+		var next *onepassEdge
+		for i := range o.edges[from] {
+			e := &o.edges[from][i]
+			if !e.holds(left, ch) {
+				continue
+			}
+			if e.target == -1 {
+				if anchor == aBoth && ch != -1 {
+					continue // the match must end with the input
+				}
+				// Lower priority branches are never preferred to this match.
+				success, capture = true, append(capture[:0], curr...)
+				e.set(capture, parser.npos())
+				break
+			}
+			if next == nil && ch != -1 && o.re.prog[e.target].match(ch) {
+				next = e // no other path to another instr may match ch
+			}
+		}
+
+		if next == nil {
+			return success, capture
+		}
+		next.set(curr, parser.npos())
+		parser.nextCh()
+		from = o.re.prog[next.target].out.idx
+	}
+}
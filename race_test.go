@@ -0,0 +1,8 @@
+//go:build race
+
+package sre2
+
+func init() {
+	// The race detector drops items from sync.Pool at random.
+	raceEnabled = true
+}
@@ -11,26 +11,67 @@ package sre2
 //    iMatch: terminal success state
 //
 // This file also describes Parse() which builds the regexp as a NFA, or
-// provides a human-readable error of the failure. MustParse() is a variation
-// which panics on an error condition.
+// provides a *ParseError describing the failure. MustParse() is a variation
+// which panics on an error condition. Patterns are parsed into a tree by the
+// syntax package, and then lowered into instructions by compile().
 
 import (
 	"fmt"
+	"io"
+	"iter"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"unicode"
+
+	"github.com/samthor/sre2/syntax"
 )
 
 // sregexp struct. Just a list of states and a number of subexpressions.
 type sregexp struct {
 	prog []*instr // List of instruction states that comprise this RE.
 
-	start int // start instr
+	start  int // start instr
+	anchor int // start instr for anchored matches, i.e. the 0th capture
+	head   int // the rune instr which loops within the prefix ".*?"
+	tail   int // the rune instr which loops within the suffix ".*?"
+
+	// Whether every match must begin at the start of the text, i.e. every path
+	// from the anchor passes through bBeginText.
+	begin bool
 
 	// Number of paired subexpressions [()'s], including the outermost brackets
 	// (i.e. which match the entire string).
 	caps int
+
+	// Names of each paired subexpression, as recorded on its iIndexCap
+	// instructions. Blank where a subexpression is unnamed.
+	names []string
+
+	// Whether to prefer leftmost-longest matches, rather than leftmost-first.
+	longest bool
+
+	// Whether to match bytes rather than runes, as per ParseBytes.
+	bytes bool
+
+	// Whether input which is not valid UTF-8 never matches, as per ParseStrict.
+	strict bool
+
+	// Literal with which every match must begin. May be nil.
+	literal *literal
+
+	// Literal which every match must contain, and whether any match may span a
+	// newline. The literal may be nil.
+	required *literal
+	lines    bool
+
+	// Lazily built DFA, for matching without submatches.
+	dfa *dfa
+
+	// One-pass matcher, for anchored matches with submatches. May be nil.
+	onepass *onepass
+
+	// Machines recycled between runs of the NFA.
+	machines sync.Pool
 }
 
 // DebugOut writes the given regexp to Stderr, for debugging.
@@ -46,6 +87,27 @@ func (r *sregexp) NumSubexps() int {
 	return r.caps - 1
 }
 
+// SubexpNames returns the names of the paired subexpressions in this regexp,
+// indexed as per MatchIndex: the name of match n is SubexpNames()[n]. The name
+// of the 0th match, for the complete found string, is always blank, as is the
+// name of any unnamed subexpression.
+func (r *sregexp) SubexpNames() []string {
+	return r.names
+}
+
+// SubexpIndex returns the index of the subexpression with the given name, as
+// declared via (?P<name>...), or -1 if there is no such subexpression.
+func (r *sregexp) SubexpIndex(name string) int {
+	if name != "" {
+		for i, n := range r.names {
+			if n == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 // instrMode describes a particular instruction type for the regexp internal
 // state machine.
 type instrMode byte
@@ -65,13 +127,15 @@ type boundaryMode byte
 
 // Enum-style definitions for the the boundaryMode type.
 const (
-	bNone            boundaryMode = iota
-	bBeginText                    // beginning of text
-	bBeginLine                    // beginning of text or line
-	bEndText                      // end of text
-	bEndLine                      // end of text or line
-	bWordBoundary                 // ascii word boundary
-	bNotWordBoundary              // inverse of above, not ascii word boundary
+	bNone                   boundaryMode = iota
+	bBeginText                           // beginning of text
+	bBeginLine                           // beginning of text or line
+	bEndText                             // end of text
+	bEndLine                             // end of text or line
+	bWordBoundary                        // ascii word boundary
+	bNotWordBoundary                     // inverse of above, not ascii word boundary
+	bUnicodeWordBoundary                 // unicode word boundary, as per (?u)
+	bNotUnicodeWordBoundary              // inverse of above, not unicode word boundary
 )
 
 // instr represents a single instruction in any regexp.
@@ -87,7 +151,7 @@ type instr struct {
 	lr boundaryMode
 
 	// rune class to match against, for iRuneClass
-	rf RuneFilter
+	rc *runeClass
 
 	// identifier of submatch for iIndexCap
 	cid   int    // numbered index
@@ -128,10 +192,14 @@ func (i *instr) String() string {
 			mode = "bWordBoundary"
 		case bNotWordBoundary:
 			mode = "bNotWordBoundary"
+		case bUnicodeWordBoundary:
+			mode = "bUnicodeWordBoundary"
+		case bNotUnicodeWordBoundary:
+			mode = "bNotUnicodeWordBoundary"
 		}
 		str += fmt.Sprintf(" iBoundaryCase [%s]", mode)
 	case iRuneClass:
-		str += fmt.Sprint(" iRuneClass ", i.rf)
+		str += fmt.Sprint(" iRuneClass ", i.rc)
 	case iMatch:
 		str += " iMatch"
 	}
@@ -140,7 +208,7 @@ func (i *instr) String() string {
 
 // Matcher method for consuming runes, thus only matches iRuneClass.
 func (s *instr) match(r rune) bool {
-	return s.mode == iRuneClass && s.rf(r)
+	return s.mode == iRuneClass && s.rc.match(r)
 }
 
 // Matcher method for iBoundaryCase. If either left or right is not within the
@@ -159,751 +227,308 @@ func (s *instr) matchBoundaryMode(left rune, right rune) bool {
 	case bEndLine:
 		return right == -1 || right == '\n'
 	case bWordBoundary, bNotWordBoundary:
-		// TODO: This is ASCII-only at this point.
-		word_range := perl_groups['w']
-		whitespace_range := perl_groups['s']
-		wb := (unicode.Is(word_range, left) && unicode.Is(whitespace_range, right)) || (unicode.Is(whitespace_range, left) && unicode.Is(word_range, right))
-		if s.lr == bWordBoundary {
-			return wb
-		} else {
-			return !wb
-		}
+		// A boundary lies between a word rune and any other, including either
+		// end of the text.
+		wb := asciiWord.match(left) != asciiWord.match(right)
+		return wb == (s.lr == bWordBoundary)
+	case bUnicodeWordBoundary, bNotUnicodeWordBoundary:
+		wb := unicodeWord.match(left) != unicodeWord.match(right)
+		return wb == (s.lr == bUnicodeWordBoundary)
 	}
 	panic("unexpected lr mode")
 }
 
-// Escape constants and their mapping to actual Unicode runes.
-var (
-	ESCAPES = map[rune]rune{
-		'a': 7, 't': 9, 'n': 10, 'v': 11, 'f': 12, 'r': 13,
-	}
+// Classes of runes, as seen to the right of an iBoundaryCase instruction. Any two
+// runes within the same class are treated identically by matchBoundaryMode, as
+// its right argument; so each class may be described by a representative rune.
+const (
+	bcEnd         = iota // end of input, i.e. -1
+	bcNewline            // '\n'
+	bcWord               // word characters, as per '\w'
+	bcUnicodeWord        // other word characters, as per '\w' with (?u)
+	bcOther              // any other rune
+	numBoundaryClasses
 )
 
-// Transient parser state, a combination of regexp and string iterator.
-type parser struct {
-	re    *sregexp
-	src   SafeReader
-	flags int64 // on/off state for flags 64-127 (subtract 64, uses bits)
-}
+// Representative runes of each boundary class.
+var boundaryRunes = [numBoundaryClasses]rune{-1, '\n', 'a', 'é', '!'}
 
-// Generate a new instruction struct for use in regexp. By default, the instr
-// will be of type 'iSplit'.
-func (p *parser) instr() *instr {
-	pos := len(p.re.prog)
-	if pos == cap(p.re.prog) {
-		if pos == 0 {
-			panic("should not have cap of zero")
-		}
-		local := p.re.prog
-		p.re.prog = make([]*instr, pos, pos*2)
-		copy(p.re.prog, local)
-	}
-	p.re.prog = p.re.prog[0 : pos+1]
-	i := &instr{pos, iSplit, nil, nil, bNone, nil, -1, ""}
-	p.re.prog[pos] = i
-	return i
-}
-
-// Determine whether the given flag is set. Requires flag in range 64-127,
-// subtracts 64 and checks for bit set in flags int64.
-func (p *parser) flag(flag int) bool {
-	if flag < 64 || flag > 127 {
-		panic(fmt.Sprintf("can't check flag, out of range: %c", flag))
-	}
-	return (p.flags & (1 << byte(flag-64))) != 0
-}
-
-// Helper method to connect instr 'from' to instr 'out'.
-// TODO: Use safer connection helpers.
-func (p *parser) out(from *instr, to *instr) {
-	if from.out == nil {
-		from.out = to
-	} else if from.mode == iSplit && from.out1 == nil {
-		from.out1 = to
-	} else {
-		panic("can't out")
-	}
-}
-
-// Consume some alternate regexps. That is, (regexp[|regexp][|regexp]...).
-// This method will return when it encounters an outer ')', and the cursor
-// will rest on that character.
-func (p *parser) alt(cname string, capture bool) (start *instr, end *instr) {
-	// Hold onto the current set of flags; reset after.
-	old_flags := p.flags
-	defer func() {
-		p.flags = old_flags
-	}()
-
-	end = p.instr() // shared end state for alt
-	alt_begin := p.instr()
-
-	// Optionally mark this as a capturing group.
-	if capture {
-		alt_begin.mode = iIndexCap
-		alt_begin.cid = p.re.caps * 2
-		alt_begin.cname = cname
-
-		end.mode = iIndexCap
-		end.cid = alt_begin.cid + 1
-		end.cname = cname
-
-		// Increment alt counter.
-		p.re.caps += 1
-	}
-
-	b_start, b_end := p.regexp()
-	start = b_start
-	p.out(b_end, end)
-
-	for p.src.curr() == '|' {
-		start = p.instr()
-		p.out(start, b_start)
-
-		p.src.nextCh()
-		b_start, b_end = p.regexp()
-		p.out(start, b_start)
-		p.out(b_end, end)
-		b_start = start
-	}
-
-	// Note: We don't move over this final bracket.
-	if p.src.curr() != ')' {
-		panic("alt must end with ')'")
-	}
-
-	// Wire up the start of this alt to the first regexp part.
-	p.out(alt_begin, start)
-
-	return alt_begin, end
-}
-
-// Consume a single rune; assumes this is being invoked as the last possible
-// option and will panic if an invalid escape sequence is found. Will return the
-// found rune (as an integer) and with cursor past the entire representation.
-func (p *parser) single_rune() rune {
-	if r := p.src.curr(); r != '\\' {
-		// This is just a regular character; return it immediately.
-		p.src.nextCh()
-		return r
-	}
-
-	if p.src.peek() == 'x' {
-		// Match hex character code.
-		var hex string
-		p.src.nextCh()
-		if p.src.nextCh() == '{' {
-			hex = p.src.literal("{", "}")
-		} else {
-			hex = fmt.Sprintf("%c%c", p.src.curr(), p.src.nextCh())
-			p.src.nextCh() // Step over the end of the hex code.
-		}
-
-		// Parse and return the corresponding rune.
-		raw, err := strconv.ParseUint(hex, 16, 32)
-		if err != nil {
-			panic(fmt.Sprintf("couldn't parse hex: %s", hex))
-		}
-		return rune(raw)
-	} else if r := ESCAPES[p.src.peek()]; r != 0 {
-		// Literally match '\n', '\r', etc.
-		p.src.nextCh()
-		p.src.nextCh()
-		return r
-	} else if unicode.Is(posix_groups["punct"], p.src.peek()) {
-		// Allow punctuation to be blindly escaped.
-		r := p.src.nextCh()
-		p.src.nextCh()
-		return r
-	} else if unicode.IsDigit(p.src.peek()) {
-		// Match octal character code (begins with digit, up to three digits).
-		oct := ""
-		p.src.nextCh()
-		for i := 0; i < 3; i++ {
-			oct += fmt.Sprintf("%c", p.src.curr())
-			if !unicode.IsDigit(p.src.nextCh()) {
-				break
-			}
-		}
-
-		// Parse and return the corresponding rune.
-		raw, err := strconv.ParseUint(oct, 8, 32)
-		if err != nil {
-			panic(fmt.Sprintf("couldn't parse oct: %s", oct))
-		}
-		return rune(raw)
-	}
+// Word characters, as per '\w' and '\w' with (?u) respectively.
+var (
+	asciiWord   = newRuneClass(tableRanges([]*unicode.RangeTable{syntax.PerlGroup('w')}))
+	unicodeWord = newRuneClass(tableRanges(syntax.UnicodePerlGroup('w')))
+)
 
-	// This is an escape sequence which does not identify a single rune.
-	panic(fmt.Sprintf("not a valid escape sequence: \\%c", p.src.peek()))
+// Find the boundary class of the given rune, which may be -1.
+func boundaryClass(r rune) byte {
+	switch {
+	case r == -1:
+		return bcEnd
+	case r == '\n':
+		return bcNewline
+	case asciiWord.match(r):
+		return bcWord
+	case unicodeWord.match(r):
+		return bcUnicodeWord
+	}
+	return bcOther
 }
 
-// Consume a single character class and provide an implementation of the
-// RuneFilter interface. Consumes the entire definition.
-func (p *parser) class(within_class bool) (filter RuneFilter) {
-	negate := false
-	switch p.src.curr() {
-	case '.':
-		if p.flag('s') {
-			filter = func(r rune) bool {
-				return true
-			}
-		} else {
-			filter = func(r rune) bool {
-				return r != '\n'
+// Cleanup the given program. Assumes the given input is a flat slice containing
+// no nil instructions. Will not clean up the first instruction, as it is always
+// the canonical entry point for the regexp.
+// Returns a similarly flat slice containing no nil instructions, however the
+// slice may potentially be smaller. Each pass runs in time linear to the size of
+// the program, so that large (e.g. heavily repeated) programs remain cheap.
+func cleanup(prog []*instr) []*instr {
+	// Resolve single-instr iSplits (including those made single by resolving
+	// their own outs) to the instr they lead to. Chains of iSplits are shortened
+	// as they are followed, and this repeats until no out changes. Loops made only
+	// of iSplits, e.g. by repeating a term which may match empty, are kept: as
+	// addstate() descends each instr just once per step, they always end. But a
+	// loop of single iSplits could never be left. NB: Don't resolve the first
+	// instr, it will always be single.
+	single := func(ci *instr) bool {
+		return ci != prog[0] && ci.mode == iSplit && (ci.out1 == nil || ci.out == ci.out1)
+	}
+	walking := make([]bool, len(prog))
+	var chain []*instr
+	follow := func(ci *instr) *instr {
+		chain = chain[:0]
+		for ci != nil && single(ci) {
+			if walking[ci.idx] {
+				panic("loop of single iSplits")
 			}
+			walking[ci.idx] = true
+			chain = append(chain, ci)
+			ci = ci.out
 		}
-		p.src.nextCh()
-	case '[':
-		if p.src.peek() == ':' {
-			// Match an ASCII/POSIX class name.
-			name := p.src.literal("[:", ":]")
-			if name[0] == '^' {
-				negate = true
-				name = name[1:]
-			}
-
-			ranges, ok := posix_groups[name]
-			if !ok {
-				panic(fmt.Sprintf("could not identify ascii/posix class: %s", name))
-			}
-			filter = func(r rune) bool {
-				return unicode.Is(ranges, r)
-			}
-		} else {
-			if within_class {
-				panic("can't match a [...] class within another class")
-			}
-			if p.src.nextCh() == '^' {
-				negate = true
-				p.src.nextCh()
-			}
-
-			// Consume and merge all valid classes within this [...] block.
-			filters := make([]RuneFilter, 0)
-			for p.src.curr() != ']' {
-				filters = append(filters, p.class(true))
-			}
-			filter = func(r rune) bool {
-				for _, rf := range filters {
-					if rf(r) {
-						return true
-					}
-				}
-				return false
-			}
-			p.src.nextCh() // Move over final ']'.
+		for _, c := range chain {
+			walking[c.idx] = false
+			c.out, c.out1 = ci, nil
 		}
-	case '\\':
-		// Match some escaped character or escaped combination.
-		if p.src.peek() == 'p' || p.src.peek() == 'P' {
-			// Match a Unicode class name.
-			negate = (p.src.nextCh() == 'P')
-			unicode_class := fmt.Sprintf("%c", p.src.nextCh())
-			if unicode_class[0] == '{' {
-				unicode_class = p.src.literal("{", "}")
-			} else {
-				p.src.nextCh() // move past the single class description
-			}
-
-			// Find and return the class.
-			if filter = matchUnicodeClass(unicode_class); filter == nil {
-				panic(fmt.Sprintf("could not identify unicode class: %s", unicode_class))
-			}
-		} else if ranges, ok := perl_groups[unicode.ToLower(p.src.peek())]; ok {
-			// We've found a Perl group.
-			negate = unicode.IsUpper(p.src.nextCh())
-			p.src.nextCh()
-			filter = func(r rune) bool {
-				return unicode.Is(ranges, r)
-			}
+		return ci
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, pi := range prog {
+			out, out1 := follow(pi.out), follow(pi.out1)
+			changed = changed || out != pi.out || out1 != pi.out1
+			pi.out, pi.out1 = out, out1
 		}
 	}
 
-	if filter == nil {
-		// Match a single rune literal, or a range (when inside a character class).
-		// Note that '-' outside a character class is treated as a literal.
-		rune := p.single_rune()
-		if p.src.curr() == '-' && within_class {
-			p.src.nextCh() // move over '-'
-			rune_high := p.single_rune()
-			if rune_high < rune {
-				panic(fmt.Sprintf("unexpected range: %c >= %c", rune, rune_high))
-			}
-			filter = matchRuneRange(rune, rune_high)
-		} else {
-			filter = matchRune(rune)
+	// Remove the resolved iSplits, and shift everything else up.
+	last := 0
+	for _, pi := range prog {
+		if !single(pi) {
+			pi.idx = last
+			prog[last] = pi
+			last++
 		}
 	}
-
-	if negate {
-		return filter.not()
+	for i := last; i < len(prog); i++ {
+		prog[i] = nil
 	}
-	return filter
-}
-
-// Build a left-right matcher of the given mode.
-func (p *parser) makeBoundaryInstr(mode boundaryMode) *instr {
-	instr := p.instr()
-	instr.mode = iBoundaryCase
-	instr.lr = mode
-	return instr
+	return prog[:last]
 }
 
-// Consume a single term at the current cursor position. This may include a
-// bracketed expression. When this function returns, the cursor will have moved
-// past the final rune in this term.
-func (p *parser) term() (start *instr, end *instr) {
-	switch p.src.curr() {
-	case -1:
-		panic("EOF in term")
-	case '*', '+', '{', '?':
-		panic(fmt.Sprintf("unexpected expansion char: %c at %d", p.src.curr(), p.src.opos))
-	case ')', '}', ']':
-		panic("unexpected close element")
-	case '(':
-		// Match a bracketed expression (or modify current flags, with '?').
-		capture := true
-		alt_id := ""
-		old_flags := p.flags
-		if p.src.nextCh() == '?' {
-			// Do something interesting before descending into this alt.
-			p.src.nextCh()
-			if p.src.curr() == 'P' {
-				p.src.nextCh() // move to '<'
-				alt_id = p.src.literal("<", ">")
-			} else {
-				// anything but 'P' means flags (and, non-captured).
-				capture = false
-				set := true
-			outer:
-				for {
-					switch p.src.curr() {
-					case ':':
-						p.src.nextCh() // move past ':'
-						break outer    // no more flags, process re
-					case ')':
-						// Return immediately: there's no instructions here, just flag sets!
-						p.src.nextCh()
-						start = p.instr()
-						return start, start
-					case '-':
-						// now we're clearing flags
-						set = false
-					default:
-						if p.src.curr() < 64 && p.src.curr() > 127 {
-							panic(fmt.Sprintf("flag not in range: %c", p.src.curr()))
-						}
-						flag := byte(p.src.curr() - 64)
-						if set {
-							p.flags |= (1 << flag)
-						} else {
-							p.flags &= ^(1 << flag)
-						}
-					}
-					p.src.nextCh()
-				}
-			}
-		}
-
-		// Now actually consume the bracketed expression.
-		start, end = p.alt(alt_id, capture)
-		if p.src.curr() != ')' {
-			panic("alt should finish on end bracket")
-		}
-		p.src.nextCh()
-		p.flags = old_flags
-		return start, end
-	case '$':
-		// Match the end of text, or (with 'm') the end of a line.
-		p.src.nextCh() // consume '$'
-		mode := bEndText
-		if p.flag('m') {
-			mode = bEndLine
-		}
-		start = p.makeBoundaryInstr(mode)
-		return start, start
-	case '^':
-		// Match the beginning of text, or (with 'm') the start of a line.
-		p.src.nextCh() // consume '^'
-		mode := bBeginText
-		if p.flag('m') {
-			mode = bBeginLine
-		}
-		start = p.makeBoundaryInstr(mode)
-		return start, start
-	case '\\':
-		// Peek forward to match backslash-escaped terms which are not character
-		// classes. If any of these branches trigger, they will return past the
-		// consumed 'term'.
-		switch p.src.peek() {
-		case 'Q':
-			// Match a complete string literal, contained between '\Q' and the nearest
-			// '\E'. Use p.src.literal() since we're not interested in interpreting any
-			// unique characters, such as e.g. \x00 or \] (punct).
-			literal := p.src.literal("\\Q", "\\E")
-			start = p.instr()
-			end = start
-			for _, rune := range literal {
-				instr := p.instr()
-				instr.mode = iRuneClass
-				instr.rf = matchRune(rune)
-				p.out(end, instr)
-				end = instr
-			}
-			return start, end
-		case 'A':
-			// Match only the beginning of text.
-			p.src.consume("\\A")
-			start = p.makeBoundaryInstr(bBeginText)
-			return start, start
-		case 'z':
-			// Match only the end of text.
-			p.src.consume("\\z")
-			start = p.makeBoundaryInstr(bEndText)
-			return start, start
-		case 'b':
-			// Match an ASCII word boundary.
-			p.src.consume("\\b")
-			start = p.makeBoundaryInstr(bWordBoundary)
-			return start, start
-		case 'B':
-			// Match a non-ASCII word boundary.
-			p.src.consume("\\B")
-			start = p.makeBoundaryInstr(bNotWordBoundary)
-			return start, start
-		}
-	}
-
-	// Try to consume a rune class.
-	start = p.instr()
-	start.mode = iRuneClass
-	start.rf = p.class(false)
-
-	if p.flag('i') {
-		// Mark this class as case-insensitive.
-		start.rf = start.rf.ignoreCase()
-	}
-
-	return start, start
+// Public interface to a compiled regexp.
+type Re interface {
+	NumSubexps() int
+	SubexpNames() []string
+	SubexpIndex(name string) int
+	Match(s string) bool
+	MatchBytes(b []byte) bool
+	MatchIndex(s string) []int
+	MatchIndexBytes(b []byte) []int
+	FullMatch(s string) bool
+	FullMatchIndex(s string) []int
+	MatchPrefix(s string) bool
+	MatchPrefixIndex(s string) []int
+	MatchReader(rr io.RuneReader) bool
+	MatchReaderIndex(rr io.RuneReader) []int
+	Stream(submatch bool) *Stream
+	Find(s string) string
+	FindBytes(b []byte) []byte
+	FindIndex(s string) []int
+	FindIndexBytes(b []byte) []int
+	FindAll(s string, n int) []string
+	FindAllBytes(b []byte, n int) [][]byte
+	FindAllIndex(s string, n int) [][]int
+	FindAllIndexBytes(b []byte, n int) [][]int
+	All(s string) iter.Seq[[]int]
+	AllBytes(b []byte) iter.Seq[[]int]
+	Expand(dst []byte, template string, src string, match []int) []byte
+	ExpandBytes(dst []byte, template []byte, src []byte, match []int) []byte
+	ReplaceAll(src string, template string) string
+	ReplaceAllBytes(src []byte, template []byte) []byte
+	ReplaceAllLiteral(src string, repl string) string
+	ReplaceAllLiteralBytes(src []byte, repl []byte) []byte
+	ReplaceAllFunc(src string, repl func(string) string) string
+	ReplaceAllFuncBytes(src []byte, repl func([]byte) []byte) []byte
+	Split(s string, n int) []string
+	SplitKeep(s string, n int) []string
+	DebugOut()
 }
 
-// Safely retrieve a given term from the given position and alt count. If the
-// passed first is true, then set it to false and perform a no-op. Otherwise,
-// retrieve the new term.
-func (p *parser) safe_term(src SafeReader, alt int, first *bool, start **instr, end **instr) {
-	if *first {
-		*first = false
-		return
-	}
-	p.src = src
-	p.re.caps = alt
-	*start, *end = p.term()
+// Generates a simple, straight-forward NFA. Matches an entire regexp from the
+// given input string. If the regexp could not be parsed, returns a non-nil
+// *ParseError: the regexp will be nil in this case.
+func Parse(src string) (Re, error) {
+	return parse(src, Options{})
 }
 
-// Consume a closure, defined as (term[repitition]). When this function returns,
-// the cursor will be resting past the final rune in this closure.
-func (p *parser) closure() (start *instr, end *instr) {
-
-	// Store state of pos/alts in case we have to reparse term.
-	revert_alts := p.re.caps
-	revert := p.src
-
-	// Grab first term.
-	start = p.instr()
-	end = start
-	t_start, t_end := p.term()
-	first := true // While true, we have a pending term.
-
-	// Req and opt represent the number of required cases, and the number of
-	// optional cases, respectively. Opt may be -1 to indicate no optional limit.
-	var req int
-	var opt int
-
-	// By default, greedily choose an optional step over continuing. If 'U' is
-	// flagged, swap this behaviour.
-	greedy := true
-	if p.flag('U') {
-		greedy = false
-	}
-	switch p.src.curr() {
-	case '?':
-		p.src.nextCh()
-		req, opt = 0, 1
-	case '*':
-		p.src.nextCh()
-		req, opt = 0, -1
-	case '+':
-		p.src.nextCh()
-		req, opt = 1, -1
-	case '{':
-		raw := p.src.literal("{", "}")
-		parts := strings.SplitN(raw, ",", 2)
-		// TODO: handle malformed int
-		req, _ = strconv.Atoi(parts[0])
-		if len(parts) == 2 {
-			if len(parts[1]) > 0 {
-				// TODO: handle malformed int
-				opt, _ = strconv.Atoi(parts[1])
-				opt -= req // {n,x} means: between n and x matches, not n req and x opt.
-				if opt < 0 {
-					panic("{n,x}: x must be greater or equal to n")
-				}
-			} else {
-				opt = -1
+// Parse the given regexp with the given Options.
+func parse(src string, opts Options) (re Re, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			re = nil // clear re so it can't be used by caller
+			switch x := r.(type) {
+			case string:
+				// Internal failure while compiling the syntax tree.
+				err = &ParseError{Code: ErrInternalError, Pattern: src, Fragment: src}
+			default:
+				panic(fmt.Sprint("unknown parse error: ", x))
 			}
 		}
-	default:
-		return t_start, t_end // nothing to see here
-	}
+	}()
 
-	if p.src.curr() == '?' {
-		greedy = !greedy
-		p.src.nextCh()
+	parseSyntax := syntax.Parse
+	if opts.Bytes {
+		parseSyntax = syntax.ParseBytes
 	}
-	end_src := p.src
-
-	if req < 0 || opt < -1 || req == 0 && opt == 0 {
-		panic("invalid req/opt combination")
+	node, err := parseSyntax(src)
+	if err != nil {
+		return nil, err
 	}
+	r := compile(node, opts.Case, opts.Bytes)
+	r.longest = opts.Longest
+	r.strict = opts.Strict
+	return r, nil
+}
 
-	// Generate all required steps.
-	for i := 0; i < req; i++ {
-		p.safe_term(revert, revert_alts, &first, &t_start, &t_end)
-
-		p.out(end, t_start)
-		end = t_end
+// Generates a NFA from the given source. If the regexp could not be parsed,
+// panics with a string error.
+func MustParse(src string) Re {
+	re, err := Parse(src)
+	if err != nil {
+		panic(err.Error())
 	}
+	return re
+}
 
-	// Generate all optional steps.
-	if opt == -1 {
-		helper := p.instr()
-		p.out(end, helper)
-		if greedy {
-			helper.out = t_start // greedily choose optional step
-		} else {
-			helper.out1 = t_start // optional step is 2nd preference
-		}
-		if end != t_end {
-			// This is a little kludgy, but basically only wires up the term to the
-			// helper iff it hasn't already been done.
-			p.out(t_end, helper)
-		}
-		end = helper
-	} else {
-		real_end := p.instr()
-
-		for i := 0; i < opt; i++ {
-			p.safe_term(revert, revert_alts, &first, &t_start, &t_end)
-
-			helper := p.instr()
-			p.out(end, helper)
-			if greedy {
-				helper.out = t_start // greedily choose optional step
-			} else {
-				helper.out1 = t_start // optional step is 2nd preference
-			}
-			p.out(helper, real_end)
+// Options configures a regexp built by ParseWith. The zero Options describes
+// the regexp built by Parse; each field may be combined with any other.
+type Options struct {
+	// Longest is set to find the leftmost-longest overall match, as per
+	// ParseLongest.
+	Longest bool
 
-			end = p.instr()
-			p.out(t_end, end)
-		}
+	// Case, if non-nil, is the SpecialCase by which case-insensitive classes
+	// and literals fold case, as per ParseCase.
+	Case unicode.SpecialCase
 
-		p.out(end, real_end)
-		end = real_end
-	}
+	// Bytes is set to match bytes rather than runes, as per ParseBytes.
+	Bytes bool
 
-	p.src = end_src
-	return start, end
+	// Strict is set to never match input which is not valid UTF-8, as per
+	// ParseStrict.
+	Strict bool
 }
 
-// Match a regexp (defined as ([closure]*)) from the parser until either: EOF,
-// the literal '|' or the literal ')'. At return, the cursor will still rest
-// on this final terminal character.
-func (p *parser) regexp() (start *instr, end *instr) {
-	start = p.instr()
-	curr := start
-
-	for {
-		if p.src.curr() == -1 || p.src.curr() == '|' || p.src.curr() == ')' {
-			break
-		}
-		s, e := p.closure()
-		p.out(curr, s)
-		curr = e
-	}
-
-	end = p.instr()
-	p.out(curr, end)
-	return start, end
+// ParseWith is as Parse, but the resulting regexp is configured by the given
+// Options, e.g. to find the leftmost-longest match while folding case as per
+// unicode.TurkishCase.
+func ParseWith(src string, opts Options) (Re, error) {
+	return parse(src, opts)
 }
 
-// Cleanup the given program. Assumes the given input is a flat slice containing
-// no nil instructions. Will not clean up the first instruction, as it is always
-// the canonical entry point for the regexp.
-// Returns a similarly flat slice containing no nil instructions, however the
-// slice may potentially be smaller.
-func cleanup(prog []*instr) []*instr {
-	// Detect iSplit recursion. We can remove this and convert it to a single path.
-	// This might happen in cases where we loop over some instructions which are
-	// not matchers, e.g. \Q\E*.
-	for i := 1; i < len(prog); i++ {
-		states := make(map[int]bool)
-		pi := prog[i]
-		var fn func(ci *instr) bool
-		fn = func(ci *instr) bool {
-			if ci != nil && ci.mode == iSplit {
-				if _, exists := states[ci.idx]; exists {
-					// We've found a recursion.
-					return true
-				}
-				states[ci.idx] = true
-				if fn(ci.out) {
-					ci.out = nil
-				}
-				if fn(ci.out1) {
-					ci.out1 = nil
-				}
-				return false
-			}
-			return false
-		}
-		fn(pi)
-	}
-
-	// Iterate through the program, and remove single-instr iSplits.
-	// NB: Don't parse the first instr, it will always be single.
-	for i := 1; i < len(prog); i++ {
-		pi := prog[i]
-		if pi.mode == iSplit && (pi.out1 == nil || pi.out == pi.out1) {
-			for j := 0; j < len(prog); j++ {
-				if prog[j] == nil {
-					continue
-				}
-				pj := prog[j]
-				if pj.out == pi {
-					pj.out = pi.out
-				}
-				if pj.out1 == pi {
-					pj.out1 = pi.out
-				}
-			}
-			prog[i] = nil
-		}
-	}
-
-	// We may now have nil gaps: shift everything up.
-	last := 0
-	for i := 0; i < len(prog); i++ {
-		if prog[i] != nil {
-			last = i
-		} else {
-			// find next non-nil, move here
-			var found int
-			for found = i; found < len(prog); found++ {
-				if prog[found] != nil {
-					break
-				}
-			}
-			if found == len(prog) {
-				break // no more entries
-			}
-
-			// move found to i
-			prog[i] = prog[found]
-			prog[i].idx = i
-			prog[found] = nil
-			last = i
-		}
+// MustParseWith is as ParseWith, but panics with a string error if the regexp
+// could not be parsed.
+func MustParseWith(src string, opts Options) Re {
+	re, err := ParseWith(src, opts)
+	if err != nil {
+		panic(err.Error())
 	}
-
-	return prog[0 : last+1]
+	return re
 }
 
-// Public interface to a compiled regexp.
-type Re interface {
-	NumSubexps() int
-	Match(s string) bool
-	MatchIndex(s string) []int
-	DebugOut()
+// ParseLongest is as Parse, but the resulting regexp finds the leftmost-longest
+// overall match: of the matches which begin leftmost, MatchIndex and the find
+// methods return the longest, regardless of the preferences expressed by
+// alternates or greedy and non-greedy repetitions.
+//
+// Only the overall match is leftmost-longest. Where several submatches describe
+// it, the preferences above still choose between them, as for Go's
+// regexp.CompilePOSIX; the POSIX rule, which prefers the longest first
+// submatch, then the longest second, and so on, is not implemented. So for
+// "(a|ab)(c|bcd)(d*)" on "abcd", the submatches are "a", "bcd" and "", rather
+// than the "ab", "c" and "d" required by POSIX.
+func ParseLongest(src string) (Re, error) {
+	return parse(src, Options{Longest: true})
 }
 
-// Helper method that generates instructions, for this parser, that would
-// match the normal input string ".*?". Returns instructions begin and final,
-// both which may be used in any way the caller likes.
-func (p *parser) makeDotStarOpt() (begin *instr, final *instr) {
-	begin = p.instr()
-	final = p.instr()
-
-	choice := p.instr()
-	p.out(begin, choice)
-	p.out(choice, final)
-
-	r := p.instr()
-	r.mode = iRuneClass
-	r.rf = func(r rune) bool { return true }
-	p.out(choice, r)
-	p.out(r, choice)
-
-	return begin, final
+// MustParseLongest is as ParseLongest, but panics with a string error if the
+// regexp could not be parsed.
+func MustParseLongest(src string) Re {
+	re, err := ParseLongest(src)
+	if err != nil {
+		panic(err.Error())
+	}
+	return re
 }
 
-// Generates a simple, straight-forward NFA. Matches an entire regexp from the
-// given input string. If the regexp could not be parsed, returns a non-nil
-// error string: the regexp will be nil in this case.
-func Parse(src string) (re Re, err *string) {
-	defer func() {
-		if r := recover(); r != nil {
-			re = nil // clear re so it can't be used by caller
-			switch x := r.(type) {
-			case string:
-				response := fmt.Sprintf("could not parse `%s`, error: %s", src, x)
-				err = &response
-			default:
-				panic(fmt.Sprint("unknown parse error: ", r))
-			}
-		}
-	}()
+// ParseCase is as Parse, but case-insensitive classes and literals fold case
+// as per the given SpecialCase, e.g. unicode.TurkishCase, under which "(?i)i"
+// matches "İ" but not "I". Other runes fold as they do for Parse.
+func ParseCase(src string, special unicode.SpecialCase) (Re, error) {
+	return parse(src, Options{Case: special})
+}
 
-	p := parser{&sregexp{make([]*instr, 0, 1), -1, 1}, NewSafeReader(src), 0}
-
-	// generate the prefix, ala ".*?("
-	// note that this has to come first, since it represents instruction zero
-	_, prefix := p.makeDotStarOpt()
-	prefix.mode = iIndexCap
-	prefix.cid = 0
-
-	// generate the suffix, ala ").*?" (followed by match)
-	suffix, match := p.makeDotStarOpt()
-	suffix.mode = iIndexCap
-	suffix.cid = 1
-	match.mode = iMatch
-
-	// parse and consume the regexp, placing it between prefix/suffix.
-	p.src.nextCh()
-	re_start, re_end := p.regexp()
-	if p.src.curr() != -1 {
-		panic("could not consume all of regexp!")
+// MustParseCase is as ParseCase, but panics with a string error if the regexp
+// could not be parsed.
+func MustParseCase(src string, special unicode.SpecialCase) Re {
+	re, err := ParseCase(src, special)
+	if err != nil {
+		panic(err.Error())
 	}
-	p.out(prefix, re_start)
-	p.out(re_end, suffix)
+	return re
+}
 
-	// cleanup and return success
-	p.re.prog = cleanup(p.re.prog)
+// ParseBytes is as Parse, but the resulting regexp matches bytes rather than
+// runes, e.g. for binary or Latin-1 input. Each byte of the input is read as a
+// single rune of the same value, as is each rune of the pattern, which may be
+// at most '\xff' (see syntax.ParseBytes). Classes only match runes up to
+// '\xff', and '\C' matches any single byte.
+func ParseBytes(src string) (Re, error) {
+	return parse(src, Options{Bytes: true})
+}
 
-	if p.re.prog[0].out1 == nil {
-		p.re.start = p.re.prog[0].out.idx
+// MustParseBytes is as ParseBytes, but panics with a string error if the regexp
+// could not be parsed.
+func MustParseBytes(src string) Re {
+	re, err := ParseBytes(src)
+	if err != nil {
+		panic(err.Error())
 	}
+	return re
+}
 
-	return p.re, nil
+// ParseStrict is as Parse, but the resulting regexp never matches input which is
+// not valid UTF-8, for use by strict validators. Such input is rejected in full,
+// even where a match lies before its first invalid byte: MatchReader and
+// Stream therefore read their input to its end before reporting a match.
+func ParseStrict(src string) (Re, error) {
+	return parse(src, Options{Strict: true})
 }
 
-// Generates a NFA from the given source. If the regexp could not be parsed,
-// panics with a string error.
-func MustParse(src string) Re {
-	re, err := Parse(src)
+// MustParseStrict is as ParseStrict, but panics with a string error if the
+// regexp could not be parsed.
+func MustParseStrict(src string) Re {
+	re, err := ParseStrict(src)
 	if err != nil {
-		panic(*err)
+		panic(err.Error())
 	}
 	return re
 }
@@ -0,0 +1,176 @@
+package sre2
+
+// Describes the replacement API of sre2. Each successive, non-overlapping match
+// (as found by All) is replaced by a template, a literal string or the result
+// of a function. Templates may refer to submatches, as described by Expand.
+
+import (
+	"iter"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expand appends template to dst, replacing variables within it by the text of
+// the corresponding submatches of src; match must be as returned by FindIndex.
+// A variable has the form $name or ${name}, where name is a non-empty sequence
+// of letters, digits and underscores. A numeric name refers to a subexpression
+// by index, and any other name to a subexpression named via (?P<name>...). As
+// $name consumes as many characters as possible, "$1x" refers to "1x"; write
+// "${1}x" instead. References to missing or unmatched subexpressions expand to
+// nothing. To insert a literal '$', write "$$".
+func (r *sregexp) Expand(dst []byte, template string, src string, match []int) []byte {
+	return expand(r, dst, template, src, match)
+}
+
+// ExpandBytes is as Expand, but the template and the submatches are read from
+// byte slices.
+func (r *sregexp) ExpandBytes(dst []byte, template []byte, src []byte, match []int) []byte {
+	return expand(r, dst, string(template), src, match)
+}
+
+// Input types which may be matched against, and sliced, interchangeably.
+type input interface {
+	string | []byte
+}
+
+// Implements Expand for any type of src.
+func expand[T input](r *sregexp, dst []byte, template string, src T, match []int) []byte {
+	for len(template) > 0 {
+		i := strings.IndexByte(template, '$')
+		if i == -1 {
+			break
+		}
+		dst = append(dst, template[:i]...)
+		template = template[i:]
+
+		if strings.HasPrefix(template, "$$") {
+			dst = append(dst, '$')
+			template = template[2:]
+			continue
+		}
+		name, rest, ok := extractVar(template)
+		if !ok {
+			// Malformed; treat the '$' as a literal.
+			dst = append(dst, '$')
+			template = template[1:]
+			continue
+		}
+		template = rest
+
+		idx, err := strconv.Atoi(name)
+		if err != nil || idx < 0 {
+			idx = r.SubexpIndex(name)
+		}
+		if idx >= 0 && idx < len(match)/2 && match[2*idx] >= 0 {
+			dst = append(dst, src[match[2*idx]:match[2*idx+1]]...)
+		}
+	}
+	return append(dst, template...)
+}
+
+// Extract the name of the variable at the start of template, which must begin
+// with '$'. Returns the name, and the remaining template following it.
+func extractVar(template string) (name string, rest string, ok bool) {
+	brace := len(template) > 1 && template[1] == '{'
+	i := 1
+	if brace {
+		i = 2
+	}
+	start := i
+	for i < len(template) {
+		r, size := utf8.DecodeRuneInString(template[i:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		i += size
+	}
+	if i == start {
+		return "", "", false // empty name is not ok
+	}
+	name = template[start:i]
+	if brace {
+		if i >= len(template) || template[i] != '}' {
+			return "", "", false // missing closing brace
+		}
+		i++
+	}
+	return name, template[i:], true
+}
+
+// Replace each of the given matches within src with the result of repl, which
+// appends to the given buffer. Returns the result, and whether there were any
+// matches at all.
+func replaceAll[T input](src T, matches iter.Seq[[]int], repl func(dst []byte, match []int) []byte) (ret []byte, ok bool) {
+	last := 0
+	for m := range matches {
+		ret = append(ret, src[last:m[0]]...)
+		ret = repl(ret, m)
+		last, ok = m[1], true
+	}
+	return append(ret, src[last:]...), ok
+}
+
+// ReplaceAll returns a copy of src, replacing each match with template. Any
+// variables within template are expanded, as per Expand.
+func (r *sregexp) ReplaceAll(src string, template string) string {
+	ret, ok := replaceAll(src, r.All(src), func(dst []byte, match []int) []byte {
+		return expand(r, dst, template, src, match)
+	})
+	if !ok {
+		return src
+	}
+	return string(ret)
+}
+
+// ReplaceAllBytes is as ReplaceAll, but operates on byte slices.
+func (r *sregexp) ReplaceAllBytes(src []byte, template []byte) []byte {
+	t := string(template)
+	ret, _ := replaceAll(src, r.AllBytes(src), func(dst []byte, match []int) []byte {
+		return expand(r, dst, t, src, match)
+	})
+	return ret
+}
+
+// ReplaceAllLiteral returns a copy of src, replacing each match with repl. The
+// replacement is used directly, without expanding any variables.
+func (r *sregexp) ReplaceAllLiteral(src string, repl string) string {
+	ret, ok := replaceAll(src, r.All(src), func(dst []byte, match []int) []byte {
+		return append(dst, repl...)
+	})
+	if !ok {
+		return src
+	}
+	return string(ret)
+}
+
+// ReplaceAllLiteralBytes is as ReplaceAllLiteral, but operates on byte slices.
+func (r *sregexp) ReplaceAllLiteralBytes(src []byte, repl []byte) []byte {
+	ret, _ := replaceAll(src, r.AllBytes(src), func(dst []byte, match []int) []byte {
+		return append(dst, repl...)
+	})
+	return ret
+}
+
+// ReplaceAllFunc returns a copy of src, replacing each match with the result of
+// calling repl on the matched text. The result is used directly, without
+// expanding any variables.
+func (r *sregexp) ReplaceAllFunc(src string, repl func(string) string) string {
+	ret, ok := replaceAll(src, r.All(src), func(dst []byte, match []int) []byte {
+		return append(dst, repl(src[match[0]:match[1]])...)
+	})
+	if !ok {
+		return src
+	}
+	return string(ret)
+}
+
+// ReplaceAllFuncBytes is as ReplaceAllFunc, but operates on byte slices. Each
+// call to repl is given a slice of src holding the match.
+func (r *sregexp) ReplaceAllFuncBytes(src []byte, repl func([]byte) []byte) []byte {
+	ret, _ := replaceAll(src, r.AllBytes(src), func(dst []byte, match []int) []byte {
+		return append(dst, repl(src[match[0]:match[1]:match[1]])...)
+	})
+	return ret
+}
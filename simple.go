@@ -1,51 +1,295 @@
 package sre2
 
+import (
+	"io"
+)
+
 func (r *sregexp) Match(src string) bool {
-	success, _ := r.run(src, false)
+	success, _ := r.run(r.reader(src), false, aNone)
 	return success
 }
 
 func (r *sregexp) MatchIndex(src string) []int {
-	_, capture := r.run(src, true)
+	_, capture := r.run(r.reader(src), true, aNone)
 	return capture
 }
 
-func (r *sregexp) run(src string, submatch bool) (success bool, capture []int) {
-	curr := makeStateList(len(r.prog))
-	next := makeStateList(len(r.prog))
-	parser := NewSafeReader(src)
+func (r *sregexp) MatchBytes(b []byte) bool {
+	success, _ := r.run(r.readerBytes(b), false, aNone)
+	return success
+}
 
-	return r._run(curr, next, &parser, src, submatch)
+func (r *sregexp) MatchIndexBytes(b []byte) []int {
+	_, capture := r.run(r.readerBytes(b), true, aNone)
+	return capture
 }
 
-func (r *sregexp) _run(curr *stateList, next *stateList, parser *SafeReader, src string, submatch bool) (success bool, capture []int) {
-	// always start with state zero
-	curr.addstate(parser, r.prog[r.start], submatch, nil)
+// MatchReader is as Match, but reads runes from rr only as they are required,
+// rather than buffering the whole input. Any error returned by rr, including
+// io.EOF, is treated as the end of the input.
+func (r *sregexp) MatchReader(rr io.RuneReader) bool {
+	success, _ := r.runReader(rr, false)
+	return success
+}
 
-	for parser.nextCh() != -1 {
-		ch := parser.curr()
-		if len(curr.states) == 0 {
-			return false, nil // no more possible states, short-circuit failure
+// MatchReaderIndex is as MatchIndex, but reads runes from rr as per MatchReader.
+// The returned indexes are counted in bytes consumed from rr, as reported by
+// its ReadRune method.
+func (r *sregexp) MatchReaderIndex(rr io.RuneReader) []int {
+	_, capture := r.runReader(rr, true)
+	return capture
+}
+
+// Run over the runes of rr, as per run(). If this regexp is strict, the rest of
+// rr is then read, and the run fails if any of its input was not valid UTF-8.
+func (r *sregexp) runReader(rr io.RuneReader, submatch bool) (success bool, capture []int) {
+	if !r.strict {
+		return r.run(r.readerRunes(rr), submatch, aNone)
+	}
+	v := &validRunes{rr: rr}
+	success, capture = r.run(r.readerRunes(v), submatch, aNone)
+	for !v.done && !v.invalid {
+		v.ReadRune()
+	}
+	if v.invalid {
+		return false, nil
+	}
+	return success, capture
+}
+
+// FullMatch is as Match, but only succeeds if the entire string matches, as if
+// the regexp were wrapped in "^(?:" and ")$".
+func (r *sregexp) FullMatch(src string) bool {
+	success, _ := r.run(r.reader(src), false, aBoth)
+	return success
+}
+
+// FullMatchIndex is as MatchIndex, but only succeeds if the entire string
+// matches, as per FullMatch.
+func (r *sregexp) FullMatchIndex(src string) []int {
+	_, capture := r.run(r.reader(src), true, aBoth)
+	return capture
+}
+
+// MatchPrefix is as Match, but only succeeds if a match begins at the start of
+// the string, as if the regexp were wrapped in "^(?:" and ")".
+func (r *sregexp) MatchPrefix(src string) bool {
+	success, _ := r.run(r.reader(src), false, aStart)
+	return success
+}
+
+// MatchPrefixIndex is as MatchIndex, but only succeeds if a match begins at the
+// start of the string, as per MatchPrefix.
+func (r *sregexp) MatchPrefixIndex(src string) []int {
+	_, capture := r.run(r.reader(src), true, aStart)
+	return capture
+}
+
+// anchorMode describes where a match must be found within the input.
+type anchorMode byte
+
+// Enum-style definitions for the anchorMode type.
+const (
+	aNone  anchorMode = iota // anywhere in the input
+	aStart                   // beginning at the start of the input
+	aBoth                    // spanning the entire input
+)
+
+func (r *sregexp) run(parser SafeReader, submatch bool, anchor anchorMode) (success bool, capture []int) {
+	if parser.invalid {
+		return false, nil // strict regexps never match invalid UTF-8
+	}
+	if r.required != nil && parser.rr == nil && r.required.index(&parser, parser.npos()) < 0 {
+		return false, nil // the required literal is not found
+	}
+	if !submatch && anchor == aNone {
+		return r.dfa.match(&parser), nil
+	}
+	if submatch && r.backtrackable(&parser) && !r.onepass.usable(&parser, anchor) {
+		return r.backtrack(&parser, anchor)
+	}
+
+	m, _ := r.machines.Get().(*machine)
+	if m == nil {
+		m = r.newMachine()
+	}
+	defer r.machines.Put(m)
+
+	if submatch && r.onepass.usable(&parser, anchor) {
+		return r.onepass.run(&parser, anchor, m.slots)
+	}
+	return r._run(m.curr, m.next, &parser, submatch, anchor)
+}
+
+// machine holds the reusable state of a single run. Each regexp recycles its
+// machines, so that runs do not allocate once warmed up.
+type machine struct {
+	slots *slotPool
+	curr  *stateList
+	next  *stateList
+}
+
+// Build a new machine for this regexp.
+func (r *sregexp) newMachine() *machine {
+	slots := &slotPool{size: r.caps << 1}
+	return &machine{slots, makeStateList(len(r.prog), slots), makeStateList(len(r.prog), slots)}
+}
+
+// Run the simulation over the remaining input in parser. This stops as soon as
+// the result is certain: see step(). Anchored matches skip the prefix ".*?" by
+// beginning directly at the 0th capture.
+func (r *sregexp) _run(curr *stateList, next *stateList, parser *SafeReader, submatch bool, anchor anchorMode) (success bool, capture []int) {
+	if anchor == aNone && r.skips() && parser.rr == nil {
+		return r.search(curr, next, parser, submatch)
+	}
+
+	// always start with state zero, unless anchored
+	start := r.start
+	if anchor != aNone {
+		start = r.anchor
+	}
+	var blank []int
+	if submatch {
+		blank = curr.slots.blank()
+	}
+	curr.addstate(parser, r.prog[start], submatch, blank)
+	curr.slots.put(blank)
+	return r.resume(curr, next, parser, submatch, anchor)
+}
+
+// Continue the simulation from the states already in curr, as per _run(). Both
+// curr and next are cleared on return, so that they may be re-used.
+func (r *sregexp) resume(curr *stateList, next *stateList, parser *SafeReader, submatch bool, anchor anchorMode) (success bool, capture []int) {
+	var m found
+
+	for len(curr.states) != 0 {
+		ch := parser.nextCh()
+		r.step(curr, next, parser, ch, submatch, anchor, &m)
+		if (m.success && !submatch) || ch == -1 {
+			break // any match will do, or there is no further input
 		}
+		curr, next = next, curr
+		next.clear() // clear next so it can be re-used
+	}
+	return r.result(curr, next, &m, submatch)
+}
+
+// Run the simulation as per _run(), for an unanchored match of a regexp which
+// may skip ahead. Rather than following the prefix ".*?", states begin at the
+// 0th capture only where a match may begin, and the parser skips ahead to the
+// next such position whenever no states remain: see skip(). This includes
+// where the states begun at a position fail at once, e.g. on a boundary.
+func (r *sregexp) search(curr *stateList, next *stateList, parser *SafeReader, submatch bool) (success bool, capture []int) {
+	var m found
+	var blank []int
+	if submatch {
+		blank = curr.slots.blank()
+		defer curr.slots.put(blank)
+	}
 
-		// move along rune paths
-		for _, st := range curr.states {
-			i := r.prog[st.idx]
-			if i.match(ch) {
-				next.addstate(parser, i.out, submatch, st.capture)
+	var required skipState
+	for {
+		// As for the prefix ".*?", no further states begin once a match is found.
+		if pos := parser.npos(); pos >= 0 && !m.success {
+			if len(curr.states) == 0 {
+				if pos = r.skip(parser, pos, &required); pos < 0 {
+					break // no match may begin
+				}
+				parser.seek(pos)
+				curr.clear() // forget instrs descended at the previous position
+			}
+			if r.literal == nil || r.literal.at(parser, pos) {
+				curr.addstate(parser, r.prog[r.anchor], submatch, blank)
+			}
+		}
+		if len(curr.states) == 0 {
+			if m.success || parser.nextCh() == -1 {
+				break
 			}
+			continue // no match begins here, so skip ahead from the next rune
+		}
+
+		ch := parser.nextCh()
+		r.step(curr, next, parser, ch, submatch, aNone, &m)
+		if (m.success && !submatch) || ch == -1 {
+			break // any match will do, or there is no further input
 		}
 		curr, next = next, curr
 		next.clear() // clear next so it can be re-used
 	}
+	return r.result(curr, next, &m, submatch)
+}
+
+// Clear curr and next so that they may be re-used, and return the result of the
+// simulation, as recorded in m.
+func (r *sregexp) result(curr *stateList, next *stateList, m *found, submatch bool) (success bool, capture []int) {
+	curr.clear()
+	next.clear()
 
-	// search for success state
-	for _, st := range curr.states {
-		if r.prog[st.idx].mode == iMatch {
-			return true, st.capture.list(r.caps)
+	if m.success && submatch {
+		capture = append([]int(nil), m.capture...)
+		curr.slots.put(m.capture)
+	}
+	return m.success, capture
+}
+
+// found describes the best match found so far by a simulation. Its capture is
+// owned by the match, and must be returned to the slotPool once it is replaced.
+type found struct {
+	success bool
+	capture []int
+}
+
+// step moves each state in curr along the rune ch, which parser has just
+// consumed, placing the resulting states into next; a ch of -1 indicates the
+// end of input. States which have reached iMatch are recorded in m. Without
+// submatches, any match will do, so this returns as soon as one is found.
+//
+// Otherwise, any states which may no longer improve upon m are discarded. For
+// leftmost-first matching, that is every state of a lower priority than the
+// match. For leftmost-longest matching, it is every state which began after the
+// match, or which has already matched itself: as curr is always ordered by the
+// position at which its states began, higher-priority states may still go on to
+// find a longer (or further left) match.
+//
+// If the match must span the entire input, then iMatch is only reached at its
+// end, and the suffix ".*?" is never followed.
+func (r *sregexp) step(curr *stateList, next *stateList, parser *SafeReader, ch rune, submatch bool, anchor anchorMode, m *found) {
+	longest := r.longest && submatch
+	for k := range curr.states {
+		st := &curr.states[k]
+		if longest && m.success && (st.capture[0] == -1 || st.capture[0] > m.capture[0]) {
+			continue // began after the match, or has not yet begun
+		}
+
+		i := r.prog[st.idx]
+		if anchor == aBoth && (st.idx == r.tail || (i.mode == iMatch && ch != -1)) {
+			continue // the match must end with the input
+		}
+		if i.mode == iMatch {
+			// The 1st capture of any iMatch describes the end of the match.
+			if !longest || !m.success || st.capture[0] < m.capture[0] || st.capture[1] > m.capture[1] {
+				m.take(st, curr.slots)
+			}
+			if !submatch || !longest {
+				return
+			}
+			continue
+		}
+		if longest && st.capture[1] != -1 {
+			continue // already matched, after the end of the match
+		}
+		if ch != -1 && i.match(ch) {
+			next.addstate(parser, i.out, submatch, st.capture)
 		}
 	}
-	return false, nil
+}
+
+// Record the given state as the match, taking ownership of its capture.
+func (m *found) take(st *state, slots *slotPool) {
+	slots.put(m.capture)
+	m.success, m.capture = true, st.capture
+	st.capture = nil
 }
 
 // stateList is used by regexp.run() to efficiently maintain an ordered list of
@@ -53,31 +297,50 @@ func (r *sregexp) _run(curr *stateList, next *stateList, parser *SafeReader, src
 type stateList struct {
 	sparse []int
 	states []state
+	slots  *slotPool // source of captures, which may be nil without submatches
+	seen   []int     // generation in which each instr was last descended
+	gen    int       // current generation, advanced by clear()
 }
 
-// state represents a state index and captureInfo pair.
+// state represents a state index and its captures. Each state owns its captures,
+// which are nil without submatches.
 type state struct {
 	idx     int
-	capture *captureInfo
+	capture []int
 }
 
 // makeStateList builds a new ordered bitset for use in the regexp.
-func makeStateList(states int) *stateList {
-	return &stateList{make([]int, states), make([]state, 0, states)}
+func makeStateList(states int, slots *slotPool) *stateList {
+	return &stateList{make([]int, states), make([]state, 0, states), slots, make([]int, states), 1}
 }
 
 // addstate descends through split/alt states and places them all in the
-// given stateList.
-func (o *stateList) addstate(p *SafeReader, st *instr, submatch bool, capture *captureInfo) {
+// given stateList. Any captures set along the way are made to capture, and
+// undone on return: each state placed takes a copy of capture.
+//
+// Each non-consuming instr is descended at most once until the stateList is
+// cleared, as any later visit may only reach the states it already placed. This
+// also ends empty loops, such as "(\b)*".
+func (o *stateList) addstate(p *SafeReader, st *instr, submatch bool, capture []int) {
+	if st.mode != iRuneClass && st.mode != iMatch {
+		if o.seen[st.idx] == o.gen {
+			return
+		}
+		o.seen[st.idx] = o.gen
+	}
 	switch st.mode {
 	case iSplit:
 		o.addstate(p, st.out, submatch, capture)
 		o.addstate(p, st.out1, submatch, capture)
 	case iIndexCap:
-		if submatch {
-			capture = capture.push(p.npos(), st.cid)
+		if !submatch {
+			o.addstate(p, st.out, submatch, capture)
+			break
 		}
+		prev := capture[st.cid]
+		capture[st.cid] = p.npos()
 		o.addstate(p, st.out, submatch, capture)
+		capture[st.cid] = prev
 	case iBoundaryCase:
 		if st.matchBoundaryMode(p.curr(), p.peek()) {
 			o.addstate(p, st.out, submatch, capture)
@@ -89,9 +352,9 @@ func (o *stateList) addstate(p *SafeReader, st *instr, submatch bool, capture *c
 	}
 }
 
-// put places the given state into the stateList. Returns true if the state was
-// previously set, and false if it was not.
-func (o *stateList) put(v int, capture *captureInfo) bool {
+// put places the given state into the stateList, with a copy of capture. Returns
+// true if the state was previously set, and false if it was not.
+func (o *stateList) put(v int, capture []int) bool {
 	pos := len(o.states)
 	if o.sparse[v] < pos && o.states[o.sparse[v]].idx == v {
 		return true // already exists
@@ -100,42 +363,52 @@ func (o *stateList) put(v int, capture *captureInfo) bool {
 	o.states = o.states[:pos+1]
 	o.sparse[v] = pos
 	o.states[pos].idx = v
-	o.states[pos].capture = capture
+	o.states[pos].capture = nil
+	if capture != nil {
+		o.states[pos].capture = append(o.slots.get(), capture...)
+	}
 	return false
 }
 
-// clear resets the stateList to be re-used.
+// clear resets the stateList to be re-used, returning the captures of its states.
 func (o *stateList) clear() {
+	for _, st := range o.states {
+		o.slots.put(st.capture)
+	}
 	o.states = o.states[0:0]
+	o.gen++
 }
 
-// captureInfo represents the submatch information for a given run. This is represented as a linked
-// list so that early states can be shared; however there's more cost in GC.
-type captureInfo struct {
-	c    int          // capture index
-	pos  int          // position in string
-	prev *captureInfo // previous node in list, or nil
+// slotPool recycles the captures of states, so that these are not allocated for
+// each state reached. Every capture holds the position of each submatch index.
+type slotPool struct {
+	size int
+	free [][]int
 }
 
-// push adds a new head to the existing submatch information, returning it. Note that the receiver
-// here may be nil.
-func (info *captureInfo) push(pos int, c int) *captureInfo {
-	// TODO: If we traverse back and remove previous instances of this capture group, then we might
-	// remove information used by other branches.
-	return &captureInfo{c, pos, info}
+// Returns an empty capture, with room for every submatch index.
+func (p *slotPool) get() []int {
+	if len(p.free) == 0 {
+		return make([]int, 0, p.size)
+	}
+	s := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return s[:0]
 }
 
-// list translates the given submatch state into a concrete []int for use by callers.
-func (info *captureInfo) list(size int) (ret []int) {
-	ret = make([]int, size<<1)
-	for i := 0; i < len(ret); i++ {
-		ret[i] = -1
+// Returns a capture with every submatch index unset.
+func (p *slotPool) blank() []int {
+	s := p.get()
+	for i := 0; i < p.size; i++ {
+		s = append(s, -1)
 	}
-	for info != nil {
-		if ret[info.c] == -1 {
-			ret[info.c] = info.pos
-		}
-		info = info.prev
+	return s
+}
+
+// Return the given capture to the pool. This may be nil, as may the pool
+// itself, where there are no submatches.
+func (p *slotPool) put(s []int) {
+	if p != nil && s != nil {
+		p.free = append(p.free, s)
 	}
-	return ret
 }
@@ -1,30 +1,118 @@
 package sre2
 
-// Describes a string parser type. Notably, allows users to examine the current
-// rune, peek at the next rune, consume literals between prefix/suffix, and
-// rebase the cursor in an absolute fashion within the underlying string. On
-// instantiation, this string parser is focused 'before' the initial string:
-// calling curr() will return -1, and peek() will return the first rune.
+// Describes a string reader type. Notably, allows users to examine the current
+// rune, peek at the next rune, and rebase the cursor in an absolute fashion
+// within the underlying string. On instantiation, this reader is focused
+// 'before' the initial string: calling curr() will return -1, and peek() will
+// return the first rune.
 //
-// Within sre2, this is used for both the parser as well as matchers to
-// traverse through the input string. The curr()/peek() semantics are most
-// useful for identifying conditions between runes, such as '\W', '\w' or '$'
-// and '^' in multiline mode.
+// Within sre2, this is used by matchers to traverse through the input string;
+// patterns themselves are read by a similar type within the syntax package.
+// The curr()/peek() semantics are most useful for identifying conditions
+// between runes, such as '\W', '\w' or '$' and '^' in multiline mode.
+//
+// The input may instead be a []byte, via NewSafeReaderBytes(). In this case,
+// runes are decoded directly from the slice, without copying it to a string.
+// It may also be an io.RuneReader, via NewSafeReaderRunes(): this is consumed
+// one rune ahead of the cursor, so that peek() continues to work, but the
+// reader may not be rebased with jump() or seek().
+//
+// Input which is not valid UTF-8 is read as utf8.DecodeRune does: each byte
+// which does not begin a valid encoding is read as a single utf8.RuneError, one
+// byte wide, and the next rune is read from the following byte. Thus every
+// position reached by the reader, and so every index reported by a matcher,
+// lies on the boundary of a rune or of an invalid byte. For strict regexps,
+// as per ParseStrict, such input never matches: see sregexp.reader().
+//
+// For regexps which match bytes, as per ParseBytes, each byte of the input is
+// instead read as a single rune of the same value: see sregexp.reader().
 
 import (
-	"strings"
+	"io"
 	"unicode/utf8"
 )
 
 type SafeReader struct {
-	str  string // backing string
-	ch   rune   // current ch
-	opos int    // previous (absolute) position in str, before ch
-	pos  int    // current (absolute) position in str, after ch
+	str     string // backing string
+	b       []byte // backing bytes, read in place of str if non-nil
+	raw     bool   // whether each byte is read as a rune, rather than decoding UTF-8
+	invalid bool   // whether the input is not valid UTF-8, only set if strict
+	ch      rune   // current ch
+	opos    int    // previous (absolute) position in str, before ch
+	pos     int    // current (absolute) position in str, after ch
+
+	// backing reader, read in place of str if non-nil
+	rr     io.RuneReader
+	peeked bool // whether the next rune has been read from rr
+	next   rune // next rune read from rr, or -1 at EOF
+	nsize  int  // width of next, in bytes
 }
 
 func NewSafeReader(str string) SafeReader {
-	return SafeReader{str, -1, -1, 0}
+	return SafeReader{str: str, ch: -1, opos: -1}
+}
+
+// NewSafeReaderBytes is as NewSafeReader, but reads from the given bytes. These
+// must not be modified while the reader is in use. A nil slice is read as the
+// empty string.
+func NewSafeReaderBytes(b []byte) SafeReader {
+	return SafeReader{b: b, ch: -1, opos: -1}
+}
+
+// NewSafeReaderRunes is as NewSafeReader, but reads runes from rr as they are
+// required. Positions are counted in bytes consumed from rr. Any error returned
+// by rr, including io.EOF, is treated as the end of the input.
+func NewSafeReaderRunes(rr io.RuneReader) SafeReader {
+	return SafeReader{rr: rr, ch: -1, opos: -1}
+}
+
+// Read the next rune from rr, if it has not already been read.
+func (r *SafeReader) fill() {
+	if !r.peeked {
+		ch, size, err := r.rr.ReadRune()
+		if err != nil {
+			ch, size = -1, 0
+		}
+		r.next, r.nsize, r.peeked = ch, size, true
+	}
+}
+
+// Length of the underlying input, in bytes.
+func (r *SafeReader) len() int {
+	if r.b != nil {
+		return len(r.b)
+	}
+	return len(r.str)
+}
+
+// Decode the rune starting at the given absolute position. Returns the rune and
+// its width in bytes.
+func (r *SafeReader) decode(at int) (rune, int) {
+	if r.raw {
+		if r.b != nil {
+			return rune(r.b[at]), 1
+		}
+		return rune(r.str[at]), 1
+	}
+	if r.b != nil {
+		return utf8.DecodeRune(r.b[at:])
+	}
+	return utf8.DecodeRuneInString(r.str[at:])
+}
+
+// Decode the rune ending at the given absolute position. Returns the rune and
+// its width in bytes.
+func (r *SafeReader) decodeLast(at int) (rune, int) {
+	if r.raw {
+		if r.b != nil {
+			return rune(r.b[at-1]), 1
+		}
+		return rune(r.str[at-1]), 1
+	}
+	if r.b != nil {
+		return utf8.DecodeLastRune(r.b[:at])
+	}
+	return utf8.DecodeLastRuneInString(r.str[:at])
 }
 
 // Absolute position after the current character, inside SafeReader. This will
@@ -41,8 +129,15 @@ func (r *SafeReader) curr() rune {
 
 // Peek at the next focus rune in SafeReader.
 func (r *SafeReader) peek() rune {
-	if r.pos < len(r.str) {
-		r, _ := utf8.DecodeRuneInString(r.str[r.pos:])
+	if r.rr != nil {
+		if r.pos < 0 {
+			return -1
+		}
+		r.fill()
+		return r.next
+	}
+	if r.pos >= 0 && r.pos < r.len() {
+		r, _ := r.decode(r.pos)
 		return r
 	}
 	return -1
@@ -51,52 +146,132 @@ func (r *SafeReader) peek() rune {
 // Move forward, and return the next rune. This will return -1 if the string is
 // at EOF.
 func (r *SafeReader) nextCh() rune {
-	if r.pos < len(r.str) {
-		rune, size := utf8.DecodeRuneInString(r.str[r.pos:])
+	if r.rr != nil {
+		if r.pos >= 0 {
+			r.fill()
+			r.peeked = false
+			r.ch = r.next
+			r.opos = r.pos
+			r.pos += r.nsize
+			if r.ch == -1 {
+				r.pos = -1
+			}
+		}
+		return r.ch
+	}
+	if r.pos >= 0 && r.pos < r.len() {
+		rune, size := r.decode(r.pos)
 		r.ch = rune
 		r.opos = r.pos
 		r.pos += size
 	} else {
 		r.ch = -1
-		r.opos = r.pos
+		r.opos = r.len()
 		r.pos = -1
 	}
 	return r.ch
 }
 
-// Refocus the parser at a given point within the parsed string. When this method
+// Refocus the reader at a given point within the string. When this method
 // returns, the current focus rune will be directly after the given index.
 func (r *SafeReader) jump(to int) {
+	if r.rr != nil {
+		panic("can't jump within a reader")
+	}
 	r.pos = to
 	r.nextCh()
 }
 
-// Consume a known literal at the given point. If the literal does not exist,
-// starting with the current focus rune, then panic.
-func (r *SafeReader) consume(str string) {
-	if r.opos == -1 {
-		panic("can't consume before reading")
+// Refocus the reader so that the next call to nextCh() returns the rune at the
+// given index. The current focus rune becomes the rune directly before it, or
+// -1 if the index is at the start of the string.
+func (r *SafeReader) seek(to int) {
+	if r.rr != nil {
+		panic("can't seek within a reader")
 	}
-	if !strings.HasPrefix(r.str[r.opos:], str) {
-		panic("could not find correct str: " + str + " in available: " + r.str[r.opos:])
+	if to == 0 {
+		r.ch, r.opos, r.pos = -1, -1, 0
+		return
 	}
-	r.jump(r.opos + len(str))
+	_, size := r.decodeLast(to)
+	r.jump(to - size)
 }
 
-// Consume a literal that *must* exist, between the given prefix and suffix.
-// Searches for the prefix starting with the current focus rune, and returns
-// this SafeReader focused on the rune directly after the suffix.
-// e.g. "abcde\Qhello\Eblah", with literal("\\Q", "\\E"), returns "hello"
-//    focus --^                         and will focus on "b" after "\E".
-func (r *SafeReader) literal(prefix string, suffix string) string {
-	r.consume(prefix)
-	start := r.opos
+// Build a SafeReader over src for this regexp, as per NewSafeReader. If this
+// regexp matches bytes, each byte is read as a rune. If this regexp is strict,
+// the reader records whether src is valid UTF-8.
+func (r *sregexp) reader(src string) SafeReader {
+	return SafeReader{str: src, ch: -1, opos: -1, raw: r.bytes, invalid: r.strict && !utf8.ValidString(src)}
+}
 
-	idx := strings.Index(r.str[r.opos:], suffix)
-	if idx == -1 {
-		panic("could not find correct suffix: " + suffix)
+// As reader(), but reads from the given bytes, as per NewSafeReaderBytes.
+func (r *sregexp) readerBytes(b []byte) SafeReader {
+	return SafeReader{b: b, ch: -1, opos: -1, raw: r.bytes, invalid: r.strict && !utf8.Valid(b)}
+}
+
+// As reader(), but reads from rr, as per NewSafeReaderRunes. If this regexp
+// matches bytes, these are read via io.ByteReader where rr supports it, and
+// otherwise by encoding each rune read from rr as UTF-8.
+func (r *sregexp) readerRunes(rr io.RuneReader) SafeReader {
+	if r.bytes {
+		br, ok := rr.(io.ByteReader)
+		if !ok {
+			br = &runeBytes{rr: rr}
+		}
+		rr = byteRunes{br}
 	}
-	r.jump(r.opos + idx + len(suffix))
+	parser := NewSafeReaderRunes(rr)
+	parser.raw = r.bytes
+	return parser
+}
 
-	return r.str[start : start+idx]
+// byteRunes is an io.RuneReader which reads each byte of br as a single rune.
+type byteRunes struct {
+	br io.ByteReader
+}
+
+func (b byteRunes) ReadRune() (rune, int, error) {
+	c, err := b.br.ReadByte()
+	if err != nil {
+		return -1, 0, err
+	}
+	return rune(c), 1, nil
+}
+
+// runeBytes is an io.ByteReader which reads the UTF-8 encoding of each rune of
+// rr in turn.
+type runeBytes struct {
+	rr  io.RuneReader
+	buf []byte // remaining bytes of the last rune read
+}
+
+func (b *runeBytes) ReadByte() (byte, error) {
+	if len(b.buf) == 0 {
+		ch, _, err := b.rr.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		b.buf = utf8.AppendRune(b.buf[:0], ch)
+	}
+	c := b.buf[0]
+	b.buf = b.buf[1:]
+	return c, nil
+}
+
+// validRunes wraps an io.RuneReader, recording whether any rune read from it
+// was not valid UTF-8, for strict regexps.
+type validRunes struct {
+	rr      io.RuneReader
+	invalid bool // whether an invalid byte has been read
+	done    bool // whether rr has returned an error
+}
+
+func (v *validRunes) ReadRune() (rune, int, error) {
+	ch, size, err := v.rr.ReadRune()
+	if err != nil {
+		v.done = true
+	} else if ch == utf8.RuneError && size == 1 {
+		v.invalid = true
+	}
+	return ch, size, err
 }
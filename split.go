@@ -0,0 +1,52 @@
+package sre2
+
+// Describes the split API of sre2, which slices a string into the substrings
+// between successive, non-overlapping matches (as found by All).
+
+// Split s into the substrings between matches, placing each match between the
+// substrings it separates if keep is set. Returns at most n substrings as per
+// strings.SplitN, not counting any kept matches.
+func (r *sregexp) split(s string, n int, keep bool) (ret []string) {
+	if n == 0 {
+		return nil
+	} else if s == "" && r.Match(s) {
+		return []string{} // as per strings.SplitN("", "", n)
+	}
+
+	beg, count := 0, 0
+	for m := range r.All(s) {
+		if n > 0 && count == n-1 {
+			break
+		}
+		if m[1] == 0 {
+			continue // an empty match at the start separates nothing
+		} else if m[0] == len(s) && m[1] == len(s) {
+			break // nor does an empty match at the end
+		}
+		ret = append(ret, s[beg:m[0]])
+		if keep {
+			ret = append(ret, s[m[0]:m[1]])
+		}
+		beg = m[1]
+		count++
+	}
+	return append(ret, s[beg:])
+}
+
+// Split slices s into the substrings separated by matches of this regexp, and
+// returns a slice of those substrings. It follows the contract of
+// strings.SplitN: if n > 0, at most n substrings are returned, the last being
+// the unsplit remainder; if n == 0, returns nil; and if n < 0, returns all of
+// the substrings. Empty matches at the start or end of s are ignored, so that
+// e.g. a regexp matching "" splits s into its individual runes, and splits ""
+// into no substrings at all.
+func (r *sregexp) Split(s string, n int) []string {
+	return r.split(s, n, false)
+}
+
+// SplitKeep is as Split, but also keeps each separating match, as an element of
+// its own between the substrings it separates. The limit n applies only to the
+// number of substrings, and not to the separators.
+func (r *sregexp) SplitKeep(s string, n int) []string {
+	return r.split(s, n, true)
+}
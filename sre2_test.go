@@ -1,8 +1,17 @@
 package sre2
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
 	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/samthor/sre2/syntax"
 )
 
 // Check the given state to be true.
@@ -26,7 +35,7 @@ func checkIntSlice(t *testing.T, expected []int, result []int, err string) {
 			}
 		}
 	}
-	checkState(t, match, fmt.Sprintf("%s: got %s, expected %s", err, result, expected))
+	checkState(t, match, fmt.Sprintf("%s: got %v, expected %v", err, result, expected))
 }
 
 // Run a selection of basic regular expressions against this package.
@@ -53,6 +62,11 @@ func TestSimpleRe(t *testing.T) {
 
 	res = r.MatchIndex("\n")
 	checkIntSlice(t, res, nil, "should return nil on failed match")
+
+	r = MustParse("^ab|cd$")
+	checkState(t, r.Match("abz"), "top-level alternate should match first")
+	checkState(t, r.Match("zcd"), "top-level alternate should match second")
+	checkState(t, !r.Match("zabcdz"), "top-level alternate should respect anchors")
 }
 
 // Test parsing an invalid RE returns an error.
@@ -73,6 +87,51 @@ func TestInvalidRe(t *testing.T) {
 	checkState(t, pass, "should panic")
 }
 
+// Test the structured errors returned by Parse.
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		src      string
+		code     ErrorCode
+		offset   int
+		fragment string
+	}{
+		{"a**", ErrMissingRepeatArgument, 2, "*"},
+		{"ab)", ErrUnexpectedClose, 2, ")"},
+		{"z(((a", ErrMissingParen, 3, "(a"},
+		{"x[ab", ErrMissingBracket, 1, "[ab"},
+		{"^\\Π$", ErrInvalidEscape, 1, "\\Π"},
+		{"a\\", ErrInvalidEscape, 1, "\\"},
+		{"[[:foo:]]", ErrInvalidCharClass, 1, "[:foo:]"},
+		{"\\p{Foo}", ErrInvalidCharClass, 0, "\\p{Foo}"},
+		{"[z-a]", ErrInvalidCharRange, 1, "z-a"},
+		{"a{2,1}", ErrInvalidRepeatSize, 1, "{2,1}"},
+		{"a{x}", ErrInvalidRepeatSize, 1, "{x}"},
+		{"a{2", ErrMissingDelimiter, 1, "{2"},
+		{"(?z)", ErrInvalidFlag, 2, "z"},
+		{"(?i", ErrMissingParen, 0, "(?i"},
+		{"(?P<a>x)(?P<a>y)", ErrDuplicateName, 8, "(?P<a>"},
+		{"(?P<>a)", ErrInvalidName, 0, "(?P<>"},
+		{"x(?P<a-b>y)", ErrInvalidName, 1, "(?P<a-b>"},
+		{"(?P<Π>a)", ErrInvalidName, 0, "(?P<Π>"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.src)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: expected *ParseError, got %v", c.src, err)
+			continue
+		}
+		checkState(t, errors.Is(err, c.code), fmt.Sprintf("%q: expected code %v, got %v", c.src, c.code, perr.Code))
+		checkState(t, perr.Offset == c.offset && perr.Fragment == c.fragment,
+			fmt.Sprintf("%q: expected %q at %d, got %q at %d", c.src, c.fragment, c.offset, perr.Fragment, perr.Offset))
+		checkState(t, perr.Pattern == c.src, "pattern should be retained")
+	}
+
+	_, err := Parse("Π(a")
+	snippet := err.(*ParseError).Snippet()
+	checkState(t, snippet == "Π(a\n ^^", "unexpected snippet: "+snippet)
+}
+
 // Test behaviour related to character classes expressed within [...].
 func TestCharClass(t *testing.T) {
 	r := MustParse("^[\t[:word:]]+$") // Match tabs and word characters.
@@ -154,9 +213,9 @@ func TestStringLiteral(t *testing.T) {
 	checkState(t, r.Match(".$\\"), "should match")
 	checkState(t, !r.Match(" $\\"), "should not match")
 
-	//	r = MustParse("^a\\Q\\E*b$") // match absolutely nothing between 'ab'
-	//	checkState(t, r.Match("ab"), "should match")
-	//	checkState(t, !r.Match("acb"), "should not match")
+	r = MustParse("^a\\Q\\E*b$") // match absolutely nothing between 'ab'
+	checkState(t, r.Match("ab"), "should match")
+	checkState(t, !r.Match("acb"), "should not match")
 }
 
 // Test closure expansion types, such as {..}, ?, +, * etc.
@@ -184,6 +243,612 @@ func TestClosureExpansion(t *testing.T) {
 	checkState(t, !r.Match("aa"), "2 should fail")
 	checkState(t, r.Match("aaa"), "3 should succeed")
 	checkState(t, r.Match("aaaaaa"), "more should succeed")
+
+	// Each copy of a repeated group shares its capture ids.
+	r = MustParse("^(a(b|c)){2,3}$")
+	checkState(t, r.NumSubexps() == 2, "copies should not add subexpressions")
+	res := r.MatchIndex("abacab")
+	checkIntSlice(t, []int{0, 6, 4, 6, 5, 6}, res, "should capture final copy")
+	res = r.MatchIndex("abac")
+	checkIntSlice(t, []int{0, 4, 2, 4, 3, 4}, res, "should capture final copy")
+	checkState(t, !r.Match("ab"), "1 should fail")
+
+	r = MustParse("^(?:x(y)?){3}$")
+	res = r.MatchIndex("xyxx")
+	checkIntSlice(t, []int{0, 4, 1, 2}, res, "should retain earlier capture")
+}
+
+// Test finding the leftmost-first match, and iterating over all matches.
+func TestFind(t *testing.T) {
+	r := MustParse("a(b*)")
+	checkState(t, r.Find("xxabbya") == "abb", "should find leftmost match")
+	checkIntSlice(t, []int{2, 5, 3, 5}, r.FindIndex("xxabbya"), "should find leftmost indexes")
+	checkState(t, r.FindIndex("xyz") == nil, "should return nil on failed find")
+
+	all := r.FindAllIndex("abxaabbb", -1)
+	checkState(t, len(all) == 3, fmt.Sprint("should find three matches, got ", all))
+	if len(all) == 3 {
+		checkIntSlice(t, []int{0, 2, 1, 2}, all[0], "first match")
+		checkIntSlice(t, []int{3, 4, 4, 4}, all[1], "second match")
+		checkIntSlice(t, []int{4, 8, 5, 8}, all[2], "third match")
+	}
+	checkState(t, len(r.FindAll("abxaabbb", 2)) == 2, "should respect limit")
+	checkState(t, r.FindAll("xyz", -1) == nil, "should return nil on no matches")
+
+	// Empty matches are not permitted directly after a previous match.
+	r = MustParse("a*")
+	found := fmt.Sprintf("%q", r.FindAll("baaacada", -1))
+	checkState(t, found == `["" "aaa" "a" "a"]`, "unexpected empty matches: "+found)
+	found = fmt.Sprintf("%q", MustParse("").FindAll("Πx", -1))
+	checkState(t, found == `["" "" ""]`, "should step over whole runes: "+found)
+
+	// Boundaries may see runes before the resumed position.
+	r = MustParse("^a|\\ba")
+	found = fmt.Sprintf("%q", r.FindAll("aa a", -1))
+	checkState(t, found == `["a" "a"]`, "should respect boundaries: "+found)
+
+	count := 0
+	for m := range MustParse("\\d+").All("1 22 333 4444") {
+		count++
+		if count == 3 {
+			checkIntSlice(t, []int{5, 8}, m, "third match")
+			break
+		}
+	}
+	checkState(t, count == 3, "iteration should stop early")
+}
+
+// Test replacing matches, and expanding templates.
+func TestReplace(t *testing.T) {
+	r := MustParse("(?P<key>\\w+)=(\\w*)")
+	src := "a=1, bc=, d=xyz"
+	cases := []struct {
+		template, expected string
+	}{
+		{"$2=$1", "1=a, =bc, xyz=d"},
+		{"${key}:${2}x", "a:1x, bc:x, d:xyzx"},
+		{"$2x", ", , "}, // refers to "2x"
+		{"$$1 $3 $missing", "$1  , $1  , $1  "},
+		{"$ ${key $}", "$ ${key $}, $ ${key $}, $ ${key $}"},
+		{"$4611686018427387904${9223372036854775807}", ", , "}, // out of range
+	}
+	for _, c := range cases {
+		result := r.ReplaceAll(src, c.template)
+		checkState(t, result == c.expected, fmt.Sprintf("%q: got %q, expected %q", c.template, result, c.expected))
+	}
+
+	checkState(t, r.ReplaceAllLiteral(src, "$1") == "$1, $1, $1", "literal should not expand")
+	result := r.ReplaceAllFunc(src, strings.ToUpper)
+	checkState(t, result == "A=1, BC=, D=XYZ", "unexpected func result: "+result)
+	checkState(t, r.ReplaceAll("none", "x") == "none", "should not replace without match")
+
+	r = MustParse("a*")
+	result = r.ReplaceAll("baaacada", "X")
+	checkState(t, result == "XbXcXdX", "unexpected empty replacement: "+result)
+
+	r = MustParse("(x)|(y)")
+	m := r.FindIndex("-y")
+	result = string(r.Expand([]byte(">"), "[$1][$2]", "-y", m))
+	checkState(t, result == ">[][y]", "unmatched group should expand to nothing: "+result)
+}
+
+// Test splitting strings by matches, as per strings.SplitN.
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		re, s    string
+		n        int
+		expected []string
+		keep     []string
+	}{
+		{",\\s*", "a, b,c,", -1, []string{"a", "b", "c", ""}, []string{"a", ", ", "b", ",", "c", ",", ""}},
+		{",\\s*", "a, b,c,", 2, []string{"a", "b,c,"}, []string{"a", ", ", "b,c,"}},
+		{",\\s*", "a, b,c,", 1, []string{"a, b,c,"}, []string{"a, b,c,"}},
+		{",\\s*", "a, b,c,", 0, nil, nil},
+		{",", ",a", -1, []string{"", "a"}, []string{"", ",", "a"}},
+		{"x", "", -1, []string{""}, []string{""}},
+		{"", "", -1, []string{}, []string{}},
+		{"x*", "", 2, []string{}, []string{}},
+		{"", "abΠ", -1, []string{"a", "b", "Π"}, []string{"a", "", "b", "", "Π"}},
+		{"x*", "axxb", -1, []string{"a", "b"}, []string{"a", "xx", "b"}},
+	}
+	for _, c := range cases {
+		r := MustParse(c.re)
+		result := fmt.Sprintf("%q", r.Split(c.s, c.n))
+		expected := fmt.Sprintf("%q", c.expected)
+		checkState(t, result == expected, fmt.Sprintf("%q split %q (%d): got %s, expected %s", c.re, c.s, c.n, result, expected))
+		result = fmt.Sprintf("%q", r.SplitKeep(c.s, c.n))
+		expected = fmt.Sprintf("%q", c.keep)
+		checkState(t, result == expected, fmt.Sprintf("%q keep %q (%d): got %s, expected %s", c.re, c.s, c.n, result, expected))
+		checkState(t, (r.Split(c.s, c.n) == nil) == (c.expected == nil), fmt.Sprintf("%q split %q (%d): unexpected nil", c.re, c.s, c.n))
+	}
+}
+
+// Test that the []byte variants agree with their string counterparts.
+func TestBytes(t *testing.T) {
+	r := MustParse("(?P<word>\\w+)Π?")
+	src := "hello wΠrld Π"
+	b := []byte(src)
+
+	checkState(t, r.MatchBytes(b) == r.Match(src), "match should agree")
+	checkIntSlice(t, r.MatchIndex(src), r.MatchIndexBytes(b), "match indexes should agree")
+	checkState(t, string(r.FindBytes(b)) == r.Find(src), "find should agree")
+	checkIntSlice(t, r.FindIndex(src), r.FindIndexBytes(b), "find indexes should agree")
+	checkState(t, r.FindBytes([]byte("!")) == nil, "failed find should be nil")
+
+	found := fmt.Sprintf("%q", r.FindAllBytes(b, -1))
+	expected := fmt.Sprintf("%q", r.FindAll(src, -1))
+	checkState(t, found == expected, fmt.Sprintf("find all should agree: got %s, expected %s", found, expected))
+	count := 0
+	for m := range r.AllBytes(b) {
+		checkIntSlice(t, r.FindAllIndex(src, -1)[count], m, "all should agree")
+		count++
+	}
+	checkState(t, count == 3, "should iterate over three matches")
+
+	result := string(r.ReplaceAllBytes(b, []byte("<${word}>")))
+	checkState(t, result == r.ReplaceAll(src, "<${word}>"), "replace should agree: "+result)
+	result = string(r.ReplaceAllLiteralBytes(b, []byte("$1")))
+	checkState(t, result == r.ReplaceAllLiteral(src, "$1"), "literal replace should agree: "+result)
+	result = string(r.ReplaceAllFuncBytes(b, bytes.ToUpper))
+	checkState(t, result == r.ReplaceAllFunc(src, strings.ToUpper), "func replace should agree: "+result)
+	result = string(r.ExpandBytes(nil, []byte("$1!"), b, r.FindIndexBytes(b)))
+	checkState(t, result == "hello!", "unexpected expansion: "+result)
+
+	// Matching bytes should not copy them.
+	long := bytes.Repeat(b, 100)
+	allocs := testing.AllocsPerRun(10, func() { r.MatchBytes(long) })
+	base := testing.AllocsPerRun(10, func() { r.MatchBytes(b) })
+	checkState(t, allocs == base, fmt.Sprintf("should not allocate per input byte: %v vs %v", allocs, base))
+}
+
+// Test matching against an io.RuneReader.
+func TestReader(t *testing.T) {
+	r := MustParse("(\\w+)\\s*$")
+	src := "Πx hello"
+	checkState(t, r.MatchReader(strings.NewReader(src)), "should match reader")
+	checkIntSlice(t, r.MatchIndex(src), r.MatchReaderIndex(strings.NewReader(src)), "indexes should agree")
+	checkIntSlice(t, []int{4, 9, 4, 9}, r.MatchReaderIndex(strings.NewReader(src)), "indexes should count bytes")
+	checkState(t, !r.MatchReader(strings.NewReader("hello!")), "should not match reader")
+	checkState(t, MustParse("^$").MatchReader(strings.NewReader("")), "should match empty reader")
+
+	// Errors end the input, and the reader is never read past them.
+	rr := &errReader{strings.NewReader("abc"), 0}
+	checkIntSlice(t, []int{0, 3}, MustParse("^.*$").MatchReaderIndex(rr), "should stop at error")
+	checkState(t, rr.reads == 4, fmt.Sprint("should read 4 times, got ", rr.reads))
+
+	// Matchers stop reading once their result is certain.
+	rr = &errReader{strings.NewReader("xxabxxxxxxxxxxxxxxxxxxxxxxxxxxx"), 0}
+	checkState(t, MustParse("a").MatchReader(rr), "should match")
+	checkState(t, rr.reads <= 4, fmt.Sprint("should stop after match, read ", rr.reads))
+	rr = &errReader{strings.NewReader("xxabbbxxxxxxxxxxxxxxxxxxxxxxxxx"), 0}
+	checkIntSlice(t, []int{2, 6}, MustParse("ab+").MatchReaderIndex(rr), "should match")
+	checkState(t, rr.reads <= 8, fmt.Sprint("should stop once match is settled, read ", rr.reads))
+}
+
+// errReader wraps an io.RuneReader, counting reads, and fails once it is done.
+type errReader struct {
+	rr    io.RuneReader
+	reads int
+}
+
+func (e *errReader) ReadRune() (rune, int, error) {
+	e.reads++
+	if ch, size, err := e.rr.ReadRune(); err == nil {
+		return ch, size, nil
+	}
+	return 0, 0, errors.New("failed")
+}
+
+// Test feeding input to a Stream in chunks.
+func TestStream(t *testing.T) {
+	cases := []struct {
+		re, src string
+	}{
+		{"(\\w+)\\s*$", "Πx hello"},
+		{"a(Π+)b", "xxaΠΠΠbΠ"},
+		{"^$", ""},
+		{"", "abc"},
+		{"^a\\b", "ab"},
+		{"(?m)^x$", "y\nx\nz"},
+		{"no", "match"},
+	}
+	for _, c := range cases {
+		r := MustParse(c.re)
+		expected := r.MatchIndex(c.src)
+
+		// Feed every possible chunk size, which will split multi-byte runes.
+		for size := 1; size <= len(c.src)+1; size++ {
+			s := r.Stream(true)
+			for i := 0; i < len(c.src); i += size {
+				s.Feed([]byte(c.src[i:min(i+size, len(c.src))]))
+			}
+			success, res := s.Close()
+			checkState(t, success == (expected != nil), fmt.Sprintf("%q on %q (%d): wrong result", c.re, c.src, size))
+			checkIntSlice(t, expected, res, fmt.Sprintf("%q on %q (%d)", c.re, c.src, size))
+
+			s = r.Stream(false)
+			s.Feed([]byte(c.src))
+			success, _ = s.Close()
+			checkState(t, success == r.Match(c.src), fmt.Sprintf("%q on %q: wrong simple result", c.re, c.src))
+		}
+	}
+
+	// Results may be certain before the end of the input.
+	var res []int
+	s := MustParse("^ab").Stream(false)
+	checkState(t, !s.Feed([]byte("a")), "match should not yet be certain")
+	checkState(t, s.Feed([]byte("bc")), "match should be certain")
+	s = MustParse("^ab").Stream(false)
+	checkState(t, s.Feed([]byte("xa")), "failure should be certain")
+	checkState(t, s.Feed([]byte("ab")), "further input should be ignored")
+	success, _ := s.Close()
+	checkState(t, !success, "should fail")
+	s = MustParse("(?:^|x)a").Stream(true)
+	checkState(t, !s.Feed([]byte("ba")), "match after 'x' is possible")
+	s = MustParse("a+").Stream(true)
+	checkState(t, !s.Feed([]byte("xaa")), "longer match is possible")
+	checkState(t, s.Feed([]byte("abc")), "match should be certain")
+	checkState(t, s.Feed([]byte("aaa")), "further input should be ignored")
+	success, res = s.Close()
+	checkState(t, success, "should succeed")
+	checkIntSlice(t, []int{1, 4}, res, "should match all a's")
+}
+
+// Test leftmost-longest matching.
+func TestLongest(t *testing.T) {
+	cases := []struct {
+		re, src        string
+		first, longest []int
+	}{
+		{"a|ab", "xab", []int{1, 2}, []int{1, 3}},
+		{"abcd|bc", "abcd", []int{0, 4}, []int{0, 4}},
+		{"bc|abcd", "abcd", []int{0, 4}, []int{0, 4}},
+		{"a+?", "aaa", []int{0, 1}, []int{0, 3}},
+		{"(a|ab)(c|bcd)", "abcd", []int{0, 4, 0, 1, 1, 4}, []int{0, 4, 0, 1, 1, 4}},
+		{"(a*)(a|b)*", "aab", []int{0, 3, 0, 2, 2, 3}, []int{0, 3, 0, 2, 2, 3}},
+		// Submatches are as per regexp.CompilePOSIX, not POSIX's {0, 4, 0, 2, 2, 3, 3, 4}.
+		{"(a|ab)(c|bcd)(d*)", "abcd", []int{0, 4, 0, 1, 1, 4, 4, 4}, []int{0, 4, 0, 1, 1, 4, 4, 4}},
+		{"(a|ab)(bc|c)", "abc", []int{0, 3, 0, 1, 1, 3}, []int{0, 3, 0, 1, 1, 3}},
+		{"x*|y+", "yyy", []int{0, 0}, []int{0, 3}},
+		{"z", "abc", nil, nil},
+	}
+	for _, c := range cases {
+		checkIntSlice(t, c.first, MustParse(c.re).FindIndex(c.src), fmt.Sprintf("%q on %q", c.re, c.src))
+		r := MustParseLongest(c.re)
+		checkIntSlice(t, c.longest, r.MatchIndex(c.src), fmt.Sprintf("longest %q on %q", c.re, c.src))
+		checkIntSlice(t, c.longest, r.FindIndex(c.src), fmt.Sprintf("longest %q on %q", c.re, c.src))
+		checkState(t, r.Match(c.src) == (c.longest != nil), fmt.Sprintf("longest %q on %q: wrong result", c.re, c.src))
+
+		s := r.Stream(true)
+		for i := range c.src {
+			s.Feed([]byte{c.src[i]})
+		}
+		_, res := s.Close()
+		checkIntSlice(t, c.longest, res, fmt.Sprintf("stream longest %q on %q", c.re, c.src))
+	}
+
+	found := fmt.Sprintf("%q", MustParseLongest("a|ab|abc").FindAll("abcabab", -1))
+	checkState(t, found == `["abc" "ab" "ab"]`, "unexpected longest matches: "+found)
+
+	_, err := ParseLongest("a(")
+	checkState(t, errors.Is(err, ErrMissingParen), "should return parse errors")
+}
+
+// Test anchored matching, without editing the pattern.
+func TestAnchored(t *testing.T) {
+	r := MustParse("a|ab")
+	checkState(t, r.FullMatch("ab"), "should match entire string")
+	checkIntSlice(t, []int{0, 2}, r.FullMatchIndex("ab"), "should prefer alternative spanning string")
+	checkState(t, !r.FullMatch("abc"), "should not match trailing text")
+	checkState(t, !r.FullMatch("xab"), "should not match leading text")
+	checkIntSlice(t, []int{0, 1}, r.MatchPrefixIndex("abc"), "should match leftmost-first prefix")
+	checkState(t, !r.MatchPrefix("xab"), "should not match leading text")
+	checkState(t, r.FullMatchIndex("abc") == nil, "should return nil on failed match")
+
+	r = MustParse("(a+)(b*)")
+	checkIntSlice(t, []int{0, 4, 0, 2, 2, 4}, r.FullMatchIndex("aabb"), "should capture groups")
+	checkIntSlice(t, []int{0, 3, 0, 2, 2, 3}, r.MatchPrefixIndex("aabc"), "should capture prefix")
+	checkState(t, !r.FullMatch("aabc"), "should not match")
+
+	// Multiline anchors within the pattern still see the whole input.
+	r = MustParse("(?m)^b$")
+	checkState(t, !r.FullMatch("a\nb"), "should not match across lines")
+	checkState(t, r.FullMatch("b"), "should match single line")
+	r = MustParse("(?m)a$\n")
+	checkState(t, r.MatchPrefix("a\nb"), "should match first line")
+
+	r = MustParse("")
+	checkState(t, r.FullMatch(""), "empty should match empty")
+	checkState(t, !r.FullMatch("a"), "empty should not match")
+	checkState(t, r.MatchPrefix("a"), "empty prefix should match")
+
+	r = MustParseLongest("a|ab")
+	checkIntSlice(t, []int{0, 2}, r.MatchPrefixIndex("abc"), "should match longest prefix")
+}
+
+// Test that the lazy DFA used by Match agrees with the NFA, including once its
+// cache has filled up.
+func TestDFA(t *testing.T) {
+	patterns := []string{
+		"a+b", "^ab", "ab$", "(?m)^b$", ".\\b.", "x\\B", "[^a]Π", "(a|b)*c{2}", "",
+	}
+	inputs := []string{
+		"", "ab", "aab", "xab", "a\nb\n", "x y", "xx", "bΠ", "abacc", "Π\n",
+	}
+	for _, pattern := range patterns {
+		for _, limit := range []int{dfaCacheLimit, 200} {
+			r := MustParse(pattern).(*sregexp)
+			r.dfa.limit = limit
+			for _, input := range inputs {
+				for k := 0; k < 2; k++ { // the second run uses cached states
+					expected := r.MatchIndex(input) != nil
+					checkState(t, r.Match(input) == expected, fmt.Sprintf("%q on %q (limit %d): expected %v", pattern, input, limit, expected))
+					checkState(t, r.MatchReader(strings.NewReader(input)) == expected, fmt.Sprintf("%q on reader %q: expected %v", pattern, input, expected))
+				}
+			}
+			checkState(t, r.dfa.size <= limit, "cache should respect its limit")
+		}
+	}
+
+	// Concurrent runs share the cache, and must not interfere with each other,
+	// even as it is reset.
+	for _, pattern := range []string{"[a-c]+d|Π+x", "\\b[a-c]+d|Π+x"} {
+		for _, limit := range []int{dfaCacheLimit, 200} {
+			r := MustParse(pattern).(*sregexp)
+			r.dfa.limit = limit
+			done := make(chan bool)
+			for k := 0; k < 4; k++ {
+				go func() {
+					for i := 0; i < 100; i++ {
+						if !r.Match("x abcd") || r.Match("abce") || !r.Match("ΠΠx") || r.Match("Πy") {
+							done <- false
+							return
+						}
+					}
+					done <- true
+				}()
+			}
+			for k := 0; k < 4; k++ {
+				checkState(t, <-done, fmt.Sprintf("%q: concurrent match failed (limit %d)", pattern, limit))
+			}
+		}
+	}
+}
+
+func TestOnepass(t *testing.T) {
+	patterns := []struct {
+		re      string
+		onepass bool
+	}{
+		{"^(\\d+)-(\\d+)$", true},
+		{"key=(\\w+);", true},
+		{"^(a*)(b*)", true},
+		{"^(?:(x)|y)*z", true},
+		{"(?m)^(a)$", true},
+		{"^((a)|(b))+", true},
+		{"", true},
+		{"^(a+?)(a*)", false},
+		{"^(\\w+)\\b(.*)", false}, // boundaries are not considered
+		{"(a|ab)(c|bcd)(d*)", false},
+		{"(\\b)*x", false},
+	}
+	inputs := []string{
+		"", "12-34", "12-34x", "key=abc;", "aabb", "aaa", "xyxz", "ab cd", "abcd", "a\nb", "x",
+	}
+	for _, c := range patterns {
+		r := MustParse(c.re).(*sregexp)
+		nfa := MustParse(c.re).(*sregexp)
+		nfa.onepass = nil
+		checkState(t, (r.onepass != nil) == c.onepass, fmt.Sprintf("%q should be one-pass: %v", c.re, c.onepass))
+		for _, input := range inputs {
+			expected := nfa.MatchIndex(input)
+			checkIntSlice(t, expected, r.MatchIndex(input), fmt.Sprintf("%q on %q", c.re, input))
+			expected = nfa.FullMatchIndex(input)
+			checkIntSlice(t, expected, r.FullMatchIndex(input), fmt.Sprintf("full %q on %q", c.re, input))
+			expected = nfa.MatchPrefixIndex(input)
+			checkIntSlice(t, expected, r.MatchPrefixIndex(input), fmt.Sprintf("prefix %q on %q", c.re, input))
+		}
+	}
+
+	checkState(t, MustParse("^(\\d+)-(\\d+)$").(*sregexp).begin, "pattern starting with ^ should begin the text")
+	checkState(t, !MustParse("(?m)^a").(*sregexp).begin, "multi-line ^ need not begin the text")
+	checkState(t, !MustParse("^a|b").(*sregexp).begin, "only some alternates begin the text")
+}
+
+func TestBacktrack(t *testing.T) {
+	patterns := []string{
+		"a+b", "(a*)(a|b)", "(a|ab)(c|bcd)(d*)", "^(\\w+)\\b(.*)", "(?m)^(b)$", "x*", "((a)|b)+?c",
+		"(a+)(b+)?$", "(?:(a)|(b))*", "Π(.)", "",
+	}
+	inputs := []string{
+		"", "ab", "aab", "xab", "abcd", "a\nb\n", "x y", "xx", "bΠa", "ababc", "aabbb",
+	}
+	anchors := []anchorMode{aNone, aStart, aBoth}
+	for _, pattern := range patterns {
+		r := MustParse(pattern).(*sregexp)
+		m := r.newMachine()
+		for _, input := range inputs {
+			for _, anchor := range anchors {
+				parser := NewSafeReader(input)
+				checkState(t, r.backtrackable(&parser), "short input should be backtrackable")
+				_, expected := r._run(m.curr, m.next, &parser, true, anchor)
+				parser = NewSafeReader(input)
+				_, result := r.backtrack(&parser, anchor)
+				checkIntSlice(t, expected, result, fmt.Sprintf("%q on %q (anchor %d)", pattern, input, anchor))
+			}
+		}
+	}
+
+	r := MustParse("\\ba(b)").(*sregexp)
+	checkIntSlice(t, []int{3, 5, 4, 5}, r.find(NewSafeReader("ab ab"), 1), "backtracker should begin at the offset")
+	parser := NewSafeReader(strings.Repeat("a", backtrackMaxBits))
+	checkState(t, !r.backtrackable(&parser), "long input should not be backtrackable")
+}
+
+// Whether the race detector is enabled, as set by race_test.go.
+var raceEnabled bool
+
+func TestAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not stable under the race detector")
+	}
+	long := strings.Repeat("x", 1<<16) + "a=bc;"
+	cases := []struct {
+		pattern string
+		input   string
+	}{
+		{"(\\w)=(b|c)+;", long},         // the NFA
+		{"^(x+)(a)=", long},             // the one-pass matcher
+		{"(\\w)=(b|c)+;", "xxa=bc;"},    // the backtracker
+		{"(\\w)=(b|c)+;", long[:1<<15]}, // the NFA, without a match
+	}
+	for _, c := range cases {
+		r := MustParse(c.pattern)
+		expected := 1.0 // the returned slice
+		if r.MatchIndex(c.input) == nil {
+			expected = 0
+		}
+		allocs := testing.AllocsPerRun(10, func() { r.MatchIndex(c.input) })
+		checkState(t, allocs == expected, fmt.Sprintf("%q: expected %v allocs, got %v", c.pattern, expected, allocs))
+	}
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	prefixes := map[string]string{
+		"abc":        "abc",
+		"ab+c":       "ab",
+		"(a)(?:bc)d": "abcd",
+		"a\\bb|c":    "",
+		"\\ba\\bb":   "ab",
+		"a*b":        "",
+		"(?:ab){2}c": "ab",
+		"ab(?i)cd":   "ab",
+		"(?i)k":      "k\u212aK",
+	}
+	for pattern, expected := range prefixes {
+		l := MustParse(pattern).(*sregexp).literal
+		result := ""
+		if l != nil {
+			result = l.str
+		}
+		checkState(t, result == expected, fmt.Sprintf("%q: expected prefix %q, got %q", pattern, expected, result))
+	}
+
+	patterns := []string{
+		"y", "xy", "x(y)", "(?i)Y", "(?i)k\\w", "\\bab", "ab$", "a+b", "(x+)x", "Πa",
+	}
+	inputs := []string{
+		"", "y", "xxxy", "xyxy", "xxY", "Kk", "kxk", "a ab", "xab", "aab", "bΠa", "xxxx",
+		strings.Repeat("x", 1<<16) + "aby",
+	}
+	for _, pattern := range patterns {
+		r := MustParse(pattern).(*sregexp)
+		plain := MustParse(pattern).(*sregexp)
+		plain.literal = nil
+		for _, input := range inputs {
+			desc := fmt.Sprintf("%q on %q", pattern, input[max(0, len(input)-8):])
+			checkState(t, r.Match(input) == plain.Match(input), desc)
+			checkIntSlice(t, plain.MatchIndex(input), r.MatchIndex(input), desc)
+			checkIntSlice(t, plain.MatchIndexBytes([]byte(input)), r.MatchIndexBytes([]byte(input)), desc)
+			checkState(t, fmt.Sprint(plain.FindAllIndex(input, -1)) == fmt.Sprint(r.FindAllIndex(input, -1)), desc)
+		}
+	}
+
+	// Where no match begins at the prefix, e.g. as a boundary fails, the search
+	// continues from the next. These inputs are too long for the backtracker.
+	cases := []struct {
+		re, src  string
+		expected []int
+	}{
+		{"\\bfoo", "xfoo" + strings.Repeat(" ", 100000) + "foo", []int{100004, 100007}},
+		{"(?m)^foo", "xfoo\n" + strings.Repeat(" ", 100000) + "\nfoo", []int{100006, 100009}},
+		{"\\Ba", "a" + strings.Repeat("b", 100000) + "ba", []int{100002, 100003}},
+		{"\\Ba", "aba", []int{2, 3}},
+	}
+	for _, c := range cases {
+		for _, r := range []Re{MustParse(c.re), MustParseLongest(c.re)} {
+			desc := fmt.Sprintf("%q on %q", c.re, c.src[max(0, len(c.src)-8):])
+			checkIntSlice(t, c.expected, r.MatchIndex(c.src), desc)
+			checkIntSlice(t, c.expected, r.FindIndex(c.src), desc)
+			checkState(t, r.Match(c.src), desc+" should match")
+		}
+	}
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	required := map[string]string{
+		"\\w+@example\\.com": "@example.com",
+		"ERROR.*timeout":     "timeout",
+		"a(bc)+d":            "abc",
+		"x(abc|abd)y":        "x",
+		"(?i)abc":            "",
+		"ab?c":               "a",
+		"[a-z]":              "",
+	}
+	for pattern, expected := range required {
+		l := MustParse(pattern).(*sregexp).required
+		result := ""
+		if l != nil {
+			result = l.str
+		}
+		checkState(t, result == expected, fmt.Sprintf("%q: expected required %q, got %q", pattern, expected, result))
+	}
+	checkState(t, MustParse("ERROR.*timeout").(*sregexp).lines, "pattern should not span lines")
+	checkState(t, !MustParse("(?s)ERROR.*timeout").(*sregexp).lines, "pattern may span lines")
+	checkState(t, !MustParse("a[^b]c").(*sregexp).lines, "negated class may span lines")
+
+	patterns := []string{
+		"\\w+@example\\.com", "\\b\\w+@example\\.com", "ERROR.*timeout", "(?s)ERROR.*timeout", "(?m)^x+(y)$",
+		"\\bab(c)", "a[^b]c",
+	}
+	long := strings.Repeat("-", 100000) + " bob@example.com"
+	inputs := []string{
+		"", "me@example.com", "x\nme@example.com\ny", "ERROR: timeout", "ERROR\ntimeout", "timeout ERROR timeout",
+		"xx\nxy\n", "ab abc", "a\nc", strings.Repeat("ERROR ", 1<<12) + "\ntimeout\nERROR timeout", long,
+	}
+	for _, pattern := range patterns {
+		r := MustParse(pattern).(*sregexp)
+		plain := MustParse(pattern).(*sregexp)
+		plain.required = nil
+		for _, input := range inputs {
+			desc := fmt.Sprintf("%q on %q", pattern, input[max(0, len(input)-8):])
+			checkState(t, r.Match(input) == plain.Match(input), desc)
+			checkIntSlice(t, plain.MatchIndex(input), r.MatchIndex(input), desc)
+			checkIntSlice(t, plain.MatchIndexBytes([]byte(input)), r.MatchIndexBytes([]byte(input)), desc)
+			checkState(t, fmt.Sprint(plain.FindAllIndex(input, -1)) == fmt.Sprint(r.FindAllIndex(input, -1)), desc)
+		}
+	}
+
+	// No match begins at the start of the line holding the literal, as the
+	// boundary fails there, but the search continues within that line.
+	for _, r := range []Re{MustParse("\\b\\w+@example\\.com"), MustParseLongest("\\b\\w+@example\\.com")} {
+		checkIntSlice(t, []int{100001, 100016}, r.MatchIndex(long), "should find inner literal")
+	}
+}
+
+// Test repetitions of terms which may match empty, including those which
+// contain no capture, against Go's regexp package.
+func TestEmptyRepeats(t *testing.T) {
+	cases := []struct{ re, src string }{
+		{"(?:b?)*", "bbb"},
+		{"^(?:b?)+$", "bbb"},
+		{"^(?:b|)+$", "bbb"},
+		{"^(?:a{0,2})*$", "aaaaa"},
+		{"^(?:x?y?)*$", "xyyx"},
+		{"(?:\\w|^|)*", "abc"},
+		{"(?:b?){2,}", "bbbb"},
+		{"(?:b?)*?c", "bbc"},
+		{"(?:(?:)*)*x", "x"},
+		{"(?:|a)+", "aa"},
+	}
+	for _, c := range cases {
+		r, std := MustParse(c.re), regexp.MustCompile(c.re)
+		full := regexp.MustCompile("^(?:" + c.re + ")$")
+		desc := fmt.Sprintf("%q on %q", c.re, c.src)
+		checkIntSlice(t, std.FindStringSubmatchIndex(c.src), r.MatchIndex(c.src), desc)
+		checkState(t, r.Match(c.src) == std.MatchString(c.src), desc+": unexpected Match")
+		checkIntSlice(t, full.FindStringSubmatchIndex(c.src), r.FullMatchIndex(c.src), desc+": unexpected FullMatchIndex")
+	}
 }
 
 // Test specific greedy/non-greedy closure types.
@@ -201,6 +866,78 @@ func TestClosureGreedy(t *testing.T) {
 	checkIntSlice(t, []int{0, 3, 0, 2, 2, 3}, res, "did not match expected")
 }
 
+// Test repetitions of terms which may match empty, including via boundaries.
+// Each empty loop is entered once at each position, and then cut.
+func TestEmptyLoops(t *testing.T) {
+	cases := []struct {
+		re, src  string
+		expected []int
+		full     bool  // whether FullMatch succeeds
+		longest  []int // the match found by ParseLongest
+	}{
+		{"(\\b)*x", "x", []int{0, 1, 0, 0}, true, []int{0, 1}},
+		{"(\\b)*", "", []int{0, 0, -1, -1}, true, []int{0, 0}},
+		{"()*", "b", []int{0, 0, 0, 0}, false, []int{0, 0}},
+		{"(a*)*", "b", []int{0, 0, 0, 0}, false, []int{0, 0}},
+		{"(a*)*", "aab", []int{0, 2, 0, 2}, false, []int{0, 2}},
+		{"(a|)*", "aab", []int{0, 2, 1, 2}, false, []int{0, 2}},
+		{"(a?)+", "aab", []int{0, 2, 1, 2}, false, []int{0, 2}},
+		{"(()|a)+", "aab", []int{0, 0, 0, 0, 0, 0}, false, []int{0, 2}},
+		{"(\\B|a)*b", "aab", []int{0, 3, 1, 2}, true, []int{0, 3}},
+
+		// Without captures, these loops are made only of iSplits.
+		{"(?:a?)+", "aab", []int{0, 2}, false, []int{0, 2}},
+		{"(?:a|)*", "aab", []int{0, 2}, false, []int{0, 2}},
+		{"(?:|a)+", "aab", []int{0, 0}, false, []int{0, 2}},
+		{"(?:\\b|a)*b", "aab", []int{0, 3}, true, []int{0, 3}},
+		{"(?:(?:[^a]){0,2})+", "bbbbbb", []int{0, 6}, true, []int{0, 6}},
+		{"(?:abb|\\w?)*?$", "aaaa", []int{0, 4}, true, []int{0, 4}},
+		{"(?:(?:a*)*b?)*c", "abbac", []int{0, 5}, true, []int{0, 5}},
+		{"(?:(?:)*)+", "b", []int{0, 0}, false, []int{0, 0}},
+		{"(?:(?:a|)+|b)*?$", "aba", []int{0, 3}, true, []int{0, 3}},
+	}
+	pad := strings.Repeat("-", 100000)
+	for _, c := range cases {
+		r := MustParse(c.re)
+		desc := fmt.Sprintf("%q on %q", c.re, c.src)
+		checkIntSlice(t, c.expected, r.MatchIndex(c.src), desc)
+		checkState(t, r.Match(c.src), desc+" should match")
+		checkState(t, r.FullMatch(c.src) == c.full, desc+": unexpected FullMatch")
+		checkIntSlice(t, c.longest, MustParseLongest(c.re).MatchIndex(c.src)[:2], desc+": unexpected longest match")
+
+		s := r.Stream(true)
+		s.Feed([]byte(c.src))
+		success, res := s.Close()
+		checkState(t, success, desc+": stream should match")
+		checkIntSlice(t, c.expected, res, desc+": unexpected stream match")
+
+		// Long inputs are matched by the NFA, rather than the backtracker. This
+		// pads the input, unless the padding itself may match, e.g. by "$".
+		if m := r.MatchIndex(pad); len(m) != 0 && m[1] != 0 {
+			continue
+		}
+		checkIntSlice(t, c.expected, r.MatchIndex(c.src+pad), fmt.Sprintf("%q on long %q", c.re, c.src))
+		checkState(t, r.Match(c.src+pad), fmt.Sprintf("%q on long %q should match", c.re, c.src))
+	}
+}
+
+// Test looking up named subexpressions.
+func TestSubexpNames(t *testing.T) {
+	r := MustParse("(?P<key>\\w+)(=)(?P<value>\\w*)")
+	names := fmt.Sprintf("%q", r.SubexpNames())
+	checkState(t, names == `["" "key" "" "value"]`, "unexpected names: "+names)
+	checkState(t, r.SubexpIndex("key") == 1, "key should be first")
+	checkState(t, r.SubexpIndex("value") == 3, "value should be third")
+	checkState(t, r.SubexpIndex("") == -1, "blank name should not be found")
+	checkState(t, r.SubexpIndex("missing") == -1, "missing name should not be found")
+
+	res := r.MatchIndex("a=b")
+	v := r.SubexpIndex("value")
+	checkIntSlice(t, []int{2, 3}, res[2*v:2*v+2], "should index value")
+
+	checkState(t, len(MustParse("abc").SubexpNames()) == 1, "should only name the 0th match")
+}
+
 // Test simple left/right matchers.
 func TestLeftRight(t *testing.T) {
 	r := MustParse("^.\\b.$")
@@ -208,6 +945,187 @@ func TestLeftRight(t *testing.T) {
 	checkState(t, r.Match(" a"), "right char is word")
 	checkState(t, !r.Match("  "), "not a boundary")
 	checkState(t, !r.Match("aa"), "not a boundary")
+	checkState(t, r.Match("a!"), "punctuation is not word")
+	checkState(t, !r.Match("!."), "not a boundary")
+}
+
+// Test that word boundaries lie between word and non-word runes, including the
+// ends of the text, and that (?u) uses Unicode word runes.
+func TestWordBoundary(t *testing.T) {
+	cases := []struct {
+		re, src  string
+		expected []int
+	}{
+		{"\\bfoo", "foo", []int{0, 3}},
+		{"\\bfoo", "(foo)", []int{1, 4}},
+		{"foo\\b", "foo.", []int{0, 3}},
+		{"\\bfoo\\b", "xfoo foo", []int{5, 8}},
+		{"\\Bfoo", "foo xfoo", []int{5, 8}},
+		{"\\B", "", []int{0, 0}},
+		{"\\b", "", nil},
+		{"\\b.", "é", nil},
+		{"(?u)\\b.", "é", []int{0, 2}},
+		{"\\Bb", "éb", nil},
+		{"(?u)\\Bb", "éb", []int{2, 3}},
+		{"(?u)\\bb", "éb", nil},
+		{"(?u)\\w+", "!naïve_٣!", []int{1, 10}},
+		{"\\w+", "naïve", []int{0, 2}},
+		{"(?u)\\d", "x٣", []int{1, 3}},
+		{"(?u)\\s", "x\u00a0", []int{1, 3}},
+		{"\\s", "x\u00a0", nil},
+		{"a\\b", "a_", nil},
+		{"_\\b", "a_!", []int{1, 2}},
+		{"\\w+", "!a_1!", []int{1, 4}},
+		{"[^\\w]", "_!", []int{1, 2}},
+		{"(?i)\\W", "_!", []int{1, 2}},
+	}
+	for _, c := range cases {
+		r := MustParse(c.re)
+		checkIntSlice(t, c.expected, r.MatchIndex(c.src), fmt.Sprintf("%q on %q", c.re, c.src))
+		checkState(t, r.Match(c.src) == (c.expected != nil), fmt.Sprintf("%q on %q should match %v", c.re, c.src, c.expected != nil))
+	}
+}
+
+// Test regexps which match bytes rather than runes.
+func TestByteMode(t *testing.T) {
+	cases := []struct {
+		re, src  string
+		expected []int
+	}{
+		{"\\xff\\C\\x00", "A\xff\x80\x00", []int{1, 4}},
+		{"a.b", "a\xe9b", []int{0, 3}},
+		{"a.b", "a\u00e9b", nil},
+		{"a..b", "a\u00e9b", []int{0, 4}},
+		{"caf\u00e9", "caf\u00e9 caf\xe9", []int{6, 10}},
+		{"(?i)\u00e9", "\xc9", []int{0, 1}},
+		{"(?i)k", "\u212ak", []int{3, 4}},
+		{"[^a]+", "a\xffb", []int{1, 3}},
+		{"\\w+", "\xe9x", []int{1, 2}},
+		{"(?u)\\w+", "\xe9x", []int{0, 2}},
+		{"(?u)\\bx", "\xe9x \xe9 x", []int{5, 6}},
+		{"\\pL", "1\xaa", []int{1, 2}},
+		{"(\\C)(\\C*)", "\u263a", []int{0, 3, 0, 1, 1, 3}},
+		{"^\\C{2}$", "\u00e9", []int{0, 2}},
+	}
+	for _, c := range cases {
+		r := MustParseBytes(c.re)
+		checkIntSlice(t, c.expected, r.MatchIndex(c.src), fmt.Sprintf("%q on %q", c.re, c.src))
+		checkIntSlice(t, c.expected, r.MatchIndexBytes([]byte(c.src)), fmt.Sprintf("%q on bytes %q", c.re, c.src))
+		checkState(t, r.Match(c.src) == (c.expected != nil), fmt.Sprintf("%q on %q should match %v", c.re, c.src, c.expected != nil))
+		if c.expected == nil {
+			continue
+		}
+		checkIntSlice(t, c.expected, r.MatchReaderIndex(strings.NewReader(c.src)), fmt.Sprintf("%q on reader %q", c.re, c.src))
+		s := r.Stream(true)
+		for i := 0; i < len(c.src); i++ {
+			s.Feed([]byte{c.src[i]})
+		}
+		_, capture := s.Close()
+		checkIntSlice(t, c.expected, capture, fmt.Sprintf("%q on stream %q", c.re, c.src))
+	}
+
+	// Readers which can't read bytes are read as UTF-8.
+	rr := &errReader{strings.NewReader("a\u263a"), 0}
+	checkIntSlice(t, []int{1, 4}, MustParseBytes("\\xe2\\C+").MatchReaderIndex(rr), "should read runes as UTF-8")
+
+	// Empty matches step over single bytes.
+	found := fmt.Sprintf("%q", MustParseBytes("").FindAll("\u00e9", -1))
+	checkState(t, found == `["" "" ""]`, "should step over single bytes: "+found)
+
+	_, err := ParseBytes("\u263a")
+	checkState(t, errors.Is(err, ErrInvalidByte), fmt.Sprint("expected invalid byte, got ", err))
+	_, err = Parse("\\C")
+	checkState(t, errors.Is(err, ErrInvalidEscape), fmt.Sprint("expected invalid escape, got ", err))
+}
+
+// Test that each invalid byte of the input is read as a single U+FFFD, and that
+// every index falls on the boundary of a rune or of an invalid byte.
+func TestInvalidUTF8(t *testing.T) {
+	cases := []struct {
+		re, src  string
+		expected []int
+	}{
+		{"\\x{FFFD}", "a\xffb", []int{1, 2}},
+		{"\\x{FFFD}+", "\xe2\x98", []int{0, 2}},
+		{"\\x{FFFD}", "\ufffd", []int{0, 3}},
+		{"(.)(.)", "\xf0\x9f\x98", []int{0, 2, 0, 1, 1, 2}},
+		{"(.)(.)", "\xf0\x9f\x98\x80", nil},
+		{"^.$", "\xff", []int{0, 1}},
+		{"b(.*)", "a\xe2b\xe2\x98\xbac\x98", []int{2, 8, 3, 8}},
+		{"\\b\\w", "\xffx", []int{1, 2}},
+		{"[^a]+", "a\xc3\x28a", []int{1, 3}},
+	}
+	for _, c := range cases {
+		r := MustParse(c.re)
+		checkIntSlice(t, c.expected, r.MatchIndex(c.src), fmt.Sprintf("%q on %q", c.re, c.src))
+		checkIntSlice(t, c.expected, r.MatchIndexBytes([]byte(c.src)), fmt.Sprintf("%q on bytes %q", c.re, c.src))
+		checkIntSlice(t, c.expected, r.MatchReaderIndex(strings.NewReader(c.src)), fmt.Sprintf("%q on reader %q", c.re, c.src))
+		checkState(t, r.Match(c.src) == (c.expected != nil), fmt.Sprintf("%q on %q should match %v", c.re, c.src, c.expected != nil))
+		s := r.Stream(true)
+		for i := 0; i < len(c.src); i++ {
+			s.Feed([]byte{c.src[i]})
+		}
+		_, capture := s.Close()
+		checkIntSlice(t, c.expected, capture, fmt.Sprintf("%q on stream %q", c.re, c.src))
+	}
+
+	// Every index of every match lies on a boundary reached by decoding forward.
+	src := "a\xe2\x98b\xff\xf0\x9f\x98\x80c\xf0\x9f\x98\xc3"
+	boundaries := map[int]bool{len(src): true}
+	for i := 0; i < len(src); {
+		boundaries[i] = true
+		_, size := utf8.DecodeRuneInString(src[i:])
+		i += size
+	}
+	for _, pattern := range []string{"", ".", "\\x{FFFD}", "[^a]+", "(.)(.)", "\\b", "\\B.", "(?s)(.*?)(\\x{FFFD}+)"} {
+		for _, m := range MustParse(pattern).FindAllIndex(src, -1) {
+			for _, idx := range m {
+				checkState(t, idx == -1 || boundaries[idx], fmt.Sprintf("%q: index %d is within a rune", pattern, idx))
+			}
+		}
+	}
+	found := fmt.Sprintf("%q", MustParse(".").FindAll("\xe2\x98", -1))
+	checkState(t, found == `["\xe2" "\x98"]`, "should match each invalid byte: "+found)
+}
+
+// Test that strict regexps never match invalid UTF-8.
+func TestStrict(t *testing.T) {
+	r := MustParseStrict("a(.)")
+	for _, src := range []string{"ab\xff", "\xffab", "ab\xe2\x98"} {
+		checkState(t, !r.Match(src), fmt.Sprintf("should not match %q", src))
+		checkState(t, !r.MatchBytes([]byte(src)), fmt.Sprintf("should not match bytes %q", src))
+		checkState(t, r.MatchIndex(src) == nil, fmt.Sprintf("should not index %q", src))
+		checkState(t, r.FindAll(src, -1) == nil, fmt.Sprintf("should not find %q", src))
+		checkState(t, !r.MatchReader(strings.NewReader(src)), fmt.Sprintf("should not match reader %q", src))
+		checkState(t, MustParse("a(.)").Match(src), fmt.Sprintf("non-strict should match %q", src))
+	}
+	checkIntSlice(t, []int{0, 4, 1, 4}, r.MatchIndex("a\ufffd"), "a valid U+FFFD should match")
+	checkIntSlice(t, []int{0, 3, 1, 3}, r.MatchReaderIndex(strings.NewReader("a\u00e9\u263a")), "valid input should match reader")
+
+	// Errors still end the input of a reader.
+	rr := &errReader{strings.NewReader("ab"), 0}
+	checkIntSlice(t, []int{0, 2, 1, 2}, r.MatchReaderIndex(rr), "should match before error")
+	checkState(t, rr.reads == 3, fmt.Sprint("should read 3 times, got ", rr.reads))
+
+	// A match within a stream is only certain once it is closed.
+	s := r.Stream(true)
+	checkState(t, !s.Feed([]byte("ab")), "match should not yet be certain")
+	checkState(t, !s.Feed([]byte("\xe2")), "incomplete rune should not yet be invalid")
+	checkState(t, !s.Feed([]byte("\x98\xba")), "complete rune should be valid")
+	success, capture := s.Close()
+	checkState(t, success, "stream should match")
+	checkIntSlice(t, []int{0, 2, 1, 2}, capture, "stream should index match")
+
+	s = r.Stream(false)
+	checkState(t, !s.Feed([]byte("ab")), "match should not yet be certain")
+	checkState(t, s.Feed([]byte("c\xff")), "invalid input should be certain")
+	success, _ = s.Close()
+	checkState(t, !success, "invalid stream should not match")
+
+	s = r.Stream(false)
+	s.Feed([]byte("ab\xe2"))
+	success, _ = s.Close()
+	checkState(t, !success, "incomplete rune at close should not match")
 }
 
 // Test general flags in sre2.
@@ -232,30 +1150,175 @@ func TestFlags(t *testing.T) {
 	checkState(t, r.Match("abc\ndef"), "multiline mode works as expected")
 }
 
-// Test the behaviour of rune filters.
-func TestRuneFilter(t *testing.T) {
-	var filter RuneFilter
+// Test the behaviour of rune classes built from single runes, ranges and tables.
+func TestRuneClassMatch(t *testing.T) {
+	var class *runeClass
+
+	class = newRuneClass([]RuneRange{{'#', '#'}})
+	checkState(t, !class.match('B'), "should not match random rune")
+	checkState(t, class.match('#'), "should match configured rune")
+
+	class = newRuneClass([]RuneRange{{'A', 'Z'}})
+	checkState(t, class.match('A'), "should match rune 'A' in range")
+	checkState(t, class.match('B'), "should match rune 'B' in range")
+	checkState(t, !class.match('a'), "should not match rune 'a', is lowercase")
 
-	filter = matchRune('#')
-	checkState(t, !filter('B'), "should not match random rune")
-	checkState(t, filter('#'), "should match configured rune")
+	class = newRuneClass(foldRanges([]RuneRange{{'A', 'Z'}}, nil))
+	checkState(t, class.match('a'), "should match rune 'a', case ignored")
+	checkState(t, class.match('A'), "should still match rune 'A', case ignored")
+
+	class = newRuneClass(tableRanges(syntax.UnicodeClass("Greek")))
+	checkState(t, class.match('Ω'), "should match omega")
+	checkState(t, !class.match('Z'), "should not match regular latin rune")
+
+	class = newRuneClass(negateRanges(tableRanges(syntax.UnicodeClass("Cyrillic"))))
+	checkState(t, class.match('%'), "should match a random non-Cyrillic rune")
+	checkState(t, !class.match('Ӄ'), "should not match Cyrillic rune")
+}
+
+// Test the sorted range sets used by rune classes.
+func TestRuneClass(t *testing.T) {
+	ranges := mergeRanges([]RuneRange{{'d', 'f'}, {'a', 'b'}, {'c', 'c'}, {0x100, 0x200}, {0x150, 0x300}, {0x400, 0x400}})
+	checkState(t, fmt.Sprint(ranges) == "[{97 102} {256 768} {1024 1024}]", fmt.Sprint("unexpected merge: ", ranges))
+	negated := negateRanges(ranges)
+	checkState(t, fmt.Sprint(negated) == "[{0 96} {103 255} {769 1023} {1025 1114111}]", fmt.Sprint("unexpected negation: ", negated))
+
+	c := newRuneClass(ranges)
+	for _, r := range []rune{-1, 0, 'a', 'f', 'g', 0x7f, 0x80, 0x100, 0x2ff, 0x300, 0x301, 0x400, 0x401, unicode.MaxRune} {
+		expected := false
+		for _, rr := range ranges {
+			expected = expected || (r >= rr.Lo && r <= rr.Hi)
+		}
+		checkState(t, c.match(r) == expected, fmt.Sprintf("%q: expected %v", r, expected))
+	}
+	checkState(t, c.String() == fmt.Sprint(ranges), "unexpected description: "+c.String())
+
+	for _, other := range []struct {
+		ranges     []RuneRange
+		intersects bool
+	}{
+		{[]RuneRange{{'f', 'z'}}, true},
+		{[]RuneRange{{'g', 0xff}, {0x301, 0x3ff}}, false},
+		{[]RuneRange{{0x2ff, 0x2ff}}, true},
+		{[]RuneRange{{0x401, unicode.MaxRune}}, false},
+	} {
+		o := newRuneClass(other.ranges)
+		checkState(t, c.intersects(o) == other.intersects && o.intersects(c) == other.intersects, fmt.Sprintf("%v should intersect: %v", other.ranges, other.intersects))
+	}
+
+	// Classes built from Unicode tables must agree with unicode.Is.
+	for _, class := range []string{"\\w", "\\pL", "\\p{Greek}", "[^\\pN\\s]", "[[:punct:]Ω-ω]", "."} {
+		node, err := syntax.Parse(class)
+		checkState(t, err == nil, "class should parse")
+		syntax.Walk(node, func(sub syntax.Node) bool {
+			n, ok := sub.(*syntax.Class)
+			if !ok {
+				return true
+			}
+			c := newRuneClass(classRanges(n, nil))
+			for r := rune(0); r < 0x3000; r++ {
+				expected := false
+				for _, item := range n.Items {
+					var m bool
+					switch item.Kind {
+					case syntax.ItemRange:
+						m = r >= item.Lo && r <= item.Hi
+					case syntax.ItemAnyNotNL:
+						m = r != '\n'
+					default:
+						m = unicode.In(r, item.Tables()...)
+					}
+					expected = expected || m != item.Negate
+				}
+				if c.match(r) != (expected != n.Negate) {
+					t.Errorf("%s: %q should match %v", class, r, expected != n.Negate)
+					break
+				}
+			}
+			return false
+		})
+	}
+}
+
+// Test that case-insensitive matching follows each rune's simple fold orbit.
+func TestFoldCase(t *testing.T) {
+	cases := []struct {
+		re    string
+		match []string
+		fail  []string
+	}{
+		{"(?i)k", []string{"k", "K", "\u212a"}, []string{"x"}},
+		{"(?i)s", []string{"s", "S", "\u017f"}, nil},
+		{"(?i)[a-c]", []string{"B", "b"}, []string{"D"}},
+		{"(?i)[^a]", []string{"b"}, []string{"a", "A"}},
+		{"(?i)[^k]", []string{"x"}, []string{"k", "K", "\u212a"}},
+		{"(?i)\\p{Lu}", []string{"A", "a", "\u00e9"}, []string{"1"}},
+		{"(?i)\\PL", []string{"1"}, []string{"a", "A", "\u212a"}},
+		{"(?i)\\p{Greek}", []string{"\u03c3", "\u03a3", "\u03c2"}, []string{"s"}},
+		{"(?i)\u03c3", []string{"\u03c3", "\u03a3", "\u03c2"}, nil},
+	}
+	for _, c := range cases {
+		r := MustParse("^" + c.re + "$")
+		for _, s := range c.match {
+			checkState(t, r.Match(s), fmt.Sprintf("%s should match %q", c.re, s))
+		}
+		for _, s := range c.fail {
+			checkState(t, !r.Match(s), fmt.Sprintf("%s should not match %q", c.re, s))
+		}
+	}
+}
+
+// Test that ParseCase folds case as per the given SpecialCase.
+func TestSpecialCase(t *testing.T) {
+	cases := []struct {
+		re    string
+		match []string
+		fail  []string
+	}{
+		{"(?i)i", []string{"i", "\u0130"}, []string{"I", "\u0131"}},
+		{"(?i)\u0131", []string{"\u0131", "I"}, []string{"i", "\u0130"}},
+		{"(?i)[a-z]+", []string{"abc", "ABC", "\u0130"}, []string{"I", "\u0131"}},
+		{"(?i)[^i]", []string{"I", "\u0131"}, []string{"i", "\u0130"}},
+		{"(?i)k", []string{"k", "K", "\u212a"}, nil},
+		{"i", []string{"i"}, []string{"\u0130"}},
+	}
+	for _, c := range cases {
+		r := MustParseCase("^"+c.re+"$", unicode.TurkishCase)
+		for _, s := range c.match {
+			checkState(t, r.Match(s), fmt.Sprintf("%s should match %q", c.re, s))
+		}
+		for _, s := range c.fail {
+			checkState(t, !r.Match(s), fmt.Sprintf("%s should not match %q", c.re, s))
+		}
+	}
+
+	// The literal prefix must also include the special folding.
+	r := MustParseCase("(?i)ix", unicode.TurkishCase)
+	checkIntSlice(t, []int{2, 5}, r.MatchIndex("Ix\u0130x"), "should skip to the dotted capital I")
+
+	// By default, folding is locale-neutral.
+	checkState(t, MustParse("^(?i)i$").Match("I"), "(?i)i should match I by default")
+	checkState(t, !MustParse("^(?i)i$").Match("\u0130"), "(?i)i should not match \u0130 by default")
+}
 
-	filter = matchRuneRange('A', 'Z')
-	checkState(t, filter('A'), "should match rune 'A' in range")
-	checkState(t, filter('B'), "should match rune 'B' in range")
-	checkState(t, !filter('a'), "should not match rune 'a', is lowercase")
+// Test that ParseWith combines its Options.
+func TestParseWith(t *testing.T) {
+	r := MustParseWith("(?i)i|ix", Options{Longest: true, Case: unicode.TurkishCase})
+	checkIntSlice(t, []int{0, 3}, r.MatchIndex("\u0130X"), "should find the longest match, folding to the dotted capital I")
+	checkState(t, !r.Match("IX"), "should not fold i to I")
+	checkIntSlice(t, []int{0, 2}, MustParseCase("(?i)i|ix", unicode.TurkishCase).MatchIndex("\u0130X"), "should find the first match")
 
-	filter = filter.ignoreCase()
-	checkState(t, filter('a'), "should match rune 'a', case ignored")
-	checkState(t, filter('A'), "should still match rune 'A', case ignored")
+	r = MustParseWith("\\C|\\C\\C", Options{Longest: true, Bytes: true})
+	checkIntSlice(t, []int{0, 2}, r.MatchIndexBytes([]byte{0xff, 0xfe}), "should find the longest match of bytes")
 
-	filter = matchUnicodeClass("Greek")
-	checkState(t, filter('Ω'), "should match omega")
-	checkState(t, !filter('Z'), "should not match regular latin rune")
+	r = MustParseWith("a+|a+b", Options{Longest: true, Strict: true})
+	checkIntSlice(t, []int{1, 4}, r.MatchIndex("xaab"), "should find the longest match of valid input")
+	checkState(t, !r.Match("xaab\xff"), "should not match invalid input")
+	checkIntSlice(t, []int{1, 3}, MustParseStrict("a+|a+b").MatchIndex("xaab"), "should find the first match")
 
-	filter = matchUnicodeClass("Cyrillic").not()
-	checkState(t, filter('%'), "should match a random non-Cyrillic rune")
-	checkState(t, !filter('Ӄ'), "should not match Cyrillic rune")
+	checkState(t, MustParseWith("a", Options{}).Match("a"), "zero Options should be as per Parse")
+	_, err := ParseWith("(", Options{Longest: true})
+	checkState(t, err != nil, "should fail to parse")
 }
 
 // Test complex grouping configuration.
@@ -265,15 +1328,16 @@ func TestGroup(t *testing.T) {
 	checkIntSlice(t, []int{0, 3, 2, 3}, res, "a should have matched last char")
 }
 
-// Test the SafeParser used by much of the code.
+// Test the SafeReader used by the matchers.
 func TestStringParser(t *testing.T) {
 	src := NewSafeReader("a{bc}d")
 
 	checkState(t, src.curr() == -1, "should not yet be parsing")
 	checkState(t, src.nextCh() == 'a', "first char should be a")
+	checkState(t, src.peek() == '{', "should peek at {")
 	checkState(t, src.nextCh() == '{', "second char should be {")
-	lit := src.literal("{", "}")
-	checkState(t, lit == "bc", "should equal contained value, got: "+lit)
+	src.jump(5)
 	checkState(t, src.curr() == 'd', "should now rest on d")
 	checkState(t, src.nextCh() == -1, "should be done now")
+	checkState(t, src.nextCh() == -1 && src.peek() == -1, "should remain done")
 }
@@ -0,0 +1,222 @@
+package sre2
+
+// Describes Stream, a matcher which is fed its input in chunks rather than
+// reading it all at once. It runs the same simulation as _run(), but pauses
+// whenever it runs out of input, keeping its current stateList and captures
+// until more input arrives. As boundary matchers must see the rune after the
+// cursor, the stream always holds back one rune until the next one is known,
+// or until the stream is closed.
+//
+// For strict regexps, every chunk is also checked to be valid UTF-8, even once
+// the simulation has finished, as invalid input fed later must still fail.
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// streamBuffer holds the bytes fed to a Stream, but not yet read by its
+// SafeReader. It is read as an io.RuneReader.
+type streamBuffer struct {
+	buf    []byte
+	closed bool // no further bytes will arrive
+	raw    bool // whether each byte is read as a rune, as per SafeReader
+}
+
+// ReadRune implements io.RuneReader. Once closed, any incomplete rune at the end
+// of the buffer is read as utf8.RuneError, one byte at a time.
+func (b *streamBuffer) ReadRune() (rune, int, error) {
+	if len(b.buf) == 0 {
+		return -1, 0, io.EOF
+	}
+	if b.raw {
+		ch := rune(b.buf[0])
+		b.buf = b.buf[1:]
+		return ch, 1, nil
+	}
+	if !b.closed && !utf8.FullRune(b.buf) {
+		panic("read past the end of a stream")
+	}
+	ch, size := utf8.DecodeRune(b.buf)
+	b.buf = b.buf[size:]
+	return ch, size, nil
+}
+
+// Whether the buffer holds at least n complete runes. Once closed, this is
+// always true, as the end of the input may be read instead.
+func (b *streamBuffer) has(n int) bool {
+	if b.closed {
+		return true
+	} else if b.raw {
+		return len(b.buf) >= n
+	}
+	buf := b.buf
+	for ; n > 0; n-- {
+		if !utf8.FullRune(buf) {
+			return false
+		}
+		_, size := utf8.DecodeRune(buf)
+		buf = buf[size:]
+	}
+	return true
+}
+
+// Stream matches a regexp against input which arrives in chunks, as per Match
+// or MatchIndex. Create one via Re.Stream(), call Feed() with each chunk, and
+// then Close() to find the result.
+type Stream struct {
+	re       *sregexp
+	submatch bool
+	in       *streamBuffer
+	parser   SafeReader
+	curr     *stateList
+	next     *stateList
+
+	started bool  // whether the initial states have been added
+	done    bool  // whether the simulation has finished
+	m       found // the best match found so far
+
+	// For strict regexps, any incomplete rune at the end of the input fed so
+	// far, and whether that input is not valid UTF-8.
+	tail    []byte
+	invalid bool
+}
+
+// Stream returns a new Stream, which matches this regexp against input fed to
+// it in chunks. If submatch is false, the stream will not track the indexes of
+// submatches, but may find its result sooner.
+func (r *sregexp) Stream(submatch bool) *Stream {
+	in := &streamBuffer{raw: r.bytes}
+	slots := &slotPool{size: r.caps << 1}
+	return &Stream{
+		re:       r,
+		submatch: submatch,
+		in:       in,
+		parser:   NewSafeReaderRunes(in),
+		curr:     makeStateList(len(r.prog), slots),
+		next:     makeStateList(len(r.prog), slots),
+	}
+}
+
+// Feed the next chunk of input to this stream. The chunk is copied, so may be
+// reused by the caller. Returns true once the result of the stream is certain:
+// either no match is possible, or a match has been found which no further input
+// may change. After this, further input is ignored, and need not be fed. For
+// strict regexps, a match is only certain once the stream is closed.
+func (s *Stream) Feed(chunk []byte) bool {
+	if s.in.closed {
+		return s.certain()
+	}
+	if s.re.strict {
+		s.validate(chunk)
+	}
+	if !s.done && !s.invalid {
+		s.in.buf = append(s.in.buf, chunk...)
+		s.advance()
+	}
+	return s.certain()
+}
+
+// Whether the result of this stream is certain, as per Feed.
+func (s *Stream) certain() bool {
+	if s.re.strict && s.m.success {
+		return s.invalid
+	}
+	return s.done || s.invalid
+}
+
+// Check that the input fed to a strict stream is valid UTF-8, holding back any
+// incomplete rune at its end until the next chunk.
+func (s *Stream) validate(chunk []byte) {
+	buf := append(s.tail, chunk...)
+	for len(buf) != 0 && utf8.FullRune(buf) {
+		ch, size := utf8.DecodeRune(buf)
+		if ch == utf8.RuneError && size == 1 {
+			s.invalid = true
+			return
+		}
+		buf = buf[size:]
+	}
+	s.tail = append(s.tail[:0], buf...)
+}
+
+// Close this stream, indicating the end of its input. Returns whether the input
+// matched and, if submatches were requested, the indexes of the match as per
+// MatchIndex. These are counted in bytes from the start of the stream.
+func (s *Stream) Close() (success bool, capture []int) {
+	s.in.closed = true
+	if s.re.strict && (s.invalid || len(s.tail) != 0) {
+		return false, nil // the input is not valid UTF-8
+	}
+	s.advance()
+	if s.m.success && s.submatch {
+		capture = append([]int(nil), s.m.capture...)
+	}
+	return s.m.success, capture
+}
+
+// Whether n runes beyond the cursor are known, including any which have already
+// been peeked at by the parser.
+func (s *Stream) ready(n int) bool {
+	if s.parser.peeked {
+		n--
+	}
+	return s.in.has(n)
+}
+
+// Advance the simulation for as long as the buffered input allows. Each step
+// requires the rune it consumes, as well as the rune after it.
+func (s *Stream) advance() {
+	if !s.started {
+		if !s.ready(1) {
+			return
+		}
+		var capture []int
+		if s.submatch {
+			capture = s.curr.slots.blank()
+		}
+		s.curr.addstate(&s.parser, s.re.prog[s.re.start], s.submatch, capture)
+		s.curr.slots.put(capture)
+		s.started = true
+		s.settle()
+	}
+
+	for !s.done && s.ready(2) {
+		ch := s.parser.nextCh()
+		s.re.step(s.curr, s.next, &s.parser, ch, s.submatch, aNone, &s.m)
+		s.curr, s.next = s.next, s.curr
+		s.next.clear() // clear next so it can be re-used
+
+		if ch == -1 || (s.m.success && !s.submatch) {
+			s.done = true
+		} else {
+			s.settle()
+		}
+	}
+}
+
+// Determine whether the result is now certain: either no states remain alive, or
+// a match has been reached which no remaining state may replace. Without
+// submatches, any match will do. For leftmost-longest matching, only the former
+// applies, as step() discards states as soon as they may no longer improve
+// upon the match.
+//
+// If every match must begin at the start of the text, then the loop of the
+// prefix ".*?" is not alive, as any match it begins will fail.
+func (s *Stream) settle() {
+	alive := false
+	for k := range s.curr.states {
+		idx := s.curr.states[k].idx
+		if s.re.prog[idx].mode == iMatch {
+			if !s.submatch || (k == 0 && !s.re.longest) {
+				s.m.take(&s.curr.states[k], s.curr.slots)
+				s.done = true
+			}
+			return
+		}
+		alive = alive || idx != s.re.head || !s.re.begin
+	}
+	if !alive {
+		s.done = true
+	}
+}
@@ -0,0 +1,383 @@
+package syntax
+
+// Describes the syntax tree produced by Parse(). Each node satisfies the Node
+// interface, and may be rendered back into an equivalent pattern via String().
+//
+// Flags such as (?i), (?m), (?s), (?U) and (?u) do not appear in the tree as nodes
+// of their own: instead, their effect is recorded on the nodes they modify
+// (e.g. Literal.FoldCase, Repeat.Greedy or the kind of an Assertion).
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node is a single element of a parsed regexp.
+type Node interface {
+	// String renders this node as a pattern which parses to an equivalent tree.
+	String() string
+
+	// write renders this node into the given builder.
+	write(b *strings.Builder)
+}
+
+// Empty matches the empty string, e.g. for "", "()" or "(?i)".
+type Empty struct{}
+
+// Literal matches a sequence of runes, e.g. "abc" or "\Qa.b\E".
+type Literal struct {
+	Runes    []rune
+	FoldCase bool // match runes case-insensitively
+}
+
+// Class matches a single rune within a character class, e.g. "[a-z\d]", "\pN"
+// or ".". A class not expressed within [...] has exactly one item.
+type Class struct {
+	Items    []ClassItem
+	Negate   bool // whether this is [^...]
+	Bracket  bool // whether this was expressed as [...]
+	FoldCase bool // match runes case-insensitively
+}
+
+// ItemKind describes a particular type of ClassItem.
+type ItemKind byte
+
+// Enum-style definitions for the ItemKind type.
+const (
+	ItemRange    ItemKind = iota // rune range from Lo to Hi, inclusive
+	ItemAnyNotNL                 // any rune except '\n', as per '.'
+	ItemAnyNL                    // any rune, as per '.' with (?s)
+	ItemPosix                    // ASCII/POSIX class, e.g. "[:alpha:]"
+	ItemPerl                     // Perl class, e.g. "\d"
+	ItemUnicode                  // Unicode class, e.g. "\pN" or "\p{Greek}"
+	ItemAnyByte                  // any byte, as per '\C' (see ParseBytes)
+)
+
+// ClassItem is a single component of a Class.
+type ClassItem struct {
+	Kind    ItemKind
+	Lo, Hi  rune   // for ItemRange
+	Name    string // for ItemPosix, ItemPerl (as the lowercase letter) and ItemUnicode
+	Negate  bool   // e.g. "[:^alpha:]", "\D" or "\PN"
+	Unicode bool   // for ItemPerl, use the Unicode definition, as per (?u)
+}
+
+// Tables returns the Unicode tables described by this item, for the named kinds
+// ItemPosix, ItemPerl and ItemUnicode. Returns nil otherwise.
+func (item ClassItem) Tables() []*unicode.RangeTable {
+	switch item.Kind {
+	case ItemPosix:
+		if t := PosixGroup(item.Name); t != nil {
+			return []*unicode.RangeTable{t}
+		}
+	case ItemPerl:
+		if item.Unicode {
+			return UnicodePerlGroup(rune(item.Name[0]))
+		}
+		if t := PerlGroup(rune(item.Name[0])); t != nil {
+			return []*unicode.RangeTable{t}
+		}
+	case ItemUnicode:
+		return UnicodeClass(item.Name)
+	}
+	return nil
+}
+
+// Concat matches each of its sub-nodes in turn.
+type Concat struct {
+	Subs []Node
+}
+
+// Alternate matches any one of its sub-nodes, preferring earlier sub-nodes.
+type Alternate struct {
+	Subs []Node
+}
+
+// Repeat matches its sub-node between Min and Max times. Max is -1 where there
+// is no upper limit, e.g. for "*" or "{n,}".
+type Repeat struct {
+	Sub      Node
+	Min, Max int
+	Greedy   bool // prefer more repetitions over fewer
+}
+
+// Capture is a capturing group, e.g. "(...)" or "(?P<name>...)". Index counts
+// groups from one, in order of their opening parenthesis.
+type Capture struct {
+	Sub   Node
+	Index int
+	Name  string // blank if unnamed
+}
+
+// AssertKind describes a particular type of Assertion.
+type AssertKind byte
+
+// Enum-style definitions for the AssertKind type.
+const (
+	BeginText              AssertKind = iota // beginning of text, e.g. "^" or "\A"
+	BeginLine                                // beginning of text or line, "^" with (?m)
+	EndText                                  // end of text, e.g. "$" or "\z"
+	EndLine                                  // end of text or line, "$" with (?m)
+	WordBoundary                             // "\b", between an ASCII word rune and any other
+	NotWordBoundary                          // "\B", anywhere but a WordBoundary
+	UnicodeWordBoundary                      // "\b" with (?u), of Unicode word runes
+	NotUnicodeWordBoundary                   // "\B" with (?u)
+)
+
+// Assertion is a zero-width match on the runes either side of the cursor.
+type Assertion struct {
+	Kind AssertKind
+}
+
+// Walk traverses the tree rooted at n in depth-first order, calling fn for each
+// node. If fn returns false, then the children of that node are skipped.
+func Walk(n Node, fn func(Node) bool) {
+	if !fn(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *Concat:
+		for _, sub := range n.Subs {
+			Walk(sub, fn)
+		}
+	case *Alternate:
+		for _, sub := range n.Subs {
+			Walk(sub, fn)
+		}
+	case *Repeat:
+		Walk(n.Sub, fn)
+	case *Capture:
+		Walk(n.Sub, fn)
+	}
+}
+
+// Runes which must be escaped outside and inside of a [...] class respectively.
+// Note that '.' matches any rune even within a class, so must be escaped there.
+const (
+	meta_runes       = `\.+*?()|[]{}^$`
+	class_meta_runes = `\[]-^.`
+)
+
+// Write a single literal rune, escaping it if required.
+func writeRune(b *strings.Builder, r rune, meta string) {
+	if strings.ContainsRune(meta, r) {
+		b.WriteRune('\\')
+		b.WriteRune(r)
+		return
+	}
+	for esc, value := range ESCAPES {
+		if value == r {
+			b.WriteRune('\\')
+			b.WriteRune(esc)
+			return
+		}
+	}
+	if unicode.IsPrint(r) {
+		b.WriteRune(r)
+	} else {
+		fmt.Fprintf(b, `\x{%x}`, r)
+	}
+}
+
+// Render the given node within a non-capturing group, if it is not already a
+// single atom; e.g. for the sub-node of a Repeat.
+func writeAtom(b *strings.Builder, n Node) {
+	atom := false
+	switch n := n.(type) {
+	case *Literal:
+		atom = len(n.Runes) == 1 || n.FoldCase
+	case *Class, *Capture, *Assertion:
+		atom = true
+	}
+	if atom {
+		n.write(b)
+	} else {
+		b.WriteString("(?:")
+		n.write(b)
+		b.WriteString(")")
+	}
+}
+
+func (n *Empty) write(b *strings.Builder) {
+	// Nothing to render.
+}
+
+func (n *Literal) write(b *strings.Builder) {
+	if n.FoldCase {
+		b.WriteString("(?i:")
+	}
+	for _, r := range n.Runes {
+		writeRune(b, r, meta_runes)
+	}
+	if n.FoldCase {
+		b.WriteString(")")
+	}
+}
+
+func (item ClassItem) write(b *strings.Builder) {
+	switch item.Kind {
+	case ItemRange:
+		writeRune(b, item.Lo, class_meta_runes)
+		if item.Hi != item.Lo {
+			b.WriteRune('-')
+			writeRune(b, item.Hi, class_meta_runes)
+		}
+	case ItemAnyNotNL:
+		b.WriteString(".")
+	case ItemAnyNL:
+		b.WriteString("(?s:.)")
+	case ItemAnyByte:
+		b.WriteString(`\C`)
+	case ItemPosix:
+		b.WriteString("[:")
+		if item.Negate {
+			b.WriteRune('^')
+		}
+		b.WriteString(item.Name + ":]")
+	case ItemPerl:
+		b.WriteRune('\\')
+		if item.Negate {
+			b.WriteString(strings.ToUpper(item.Name))
+		} else {
+			b.WriteString(item.Name)
+		}
+	case ItemUnicode:
+		if item.Negate {
+			b.WriteString(`\P`)
+		} else {
+			b.WriteString(`\p`)
+		}
+		if len(item.Name) == 1 {
+			b.WriteString(item.Name)
+		} else {
+			b.WriteString("{" + item.Name + "}")
+		}
+	}
+}
+
+func (n *Class) write(b *strings.Builder) {
+	// We can't set flags within a class, so set (?u) around the whole class if
+	// any of its items require it.
+	uni := false
+	for _, item := range n.Items {
+		uni = uni || item.Unicode
+	}
+	if uni {
+		b.WriteString("(?u:")
+	}
+	if n.FoldCase {
+		b.WriteString("(?i:")
+	}
+	if n.Bracket {
+		b.WriteRune('[')
+		if n.Negate {
+			b.WriteRune('^')
+		}
+		for _, item := range n.Items {
+			if item.Kind == ItemAnyNL {
+				// We can't set flags within a class, so render the equivalent.
+				b.WriteString(`\x{0}-\x{10ffff}`)
+				continue
+			}
+			item.write(b)
+		}
+		b.WriteRune(']')
+	} else {
+		n.Items[0].write(b)
+	}
+	if n.FoldCase {
+		b.WriteString(")")
+	}
+	if uni {
+		b.WriteString(")")
+	}
+}
+
+func (n *Concat) write(b *strings.Builder) {
+	for _, sub := range n.Subs {
+		if _, ok := sub.(*Alternate); ok {
+			writeAtom(b, sub)
+		} else {
+			sub.write(b)
+		}
+	}
+}
+
+func (n *Alternate) write(b *strings.Builder) {
+	for i, sub := range n.Subs {
+		if i != 0 {
+			b.WriteRune('|')
+		}
+		sub.write(b)
+	}
+}
+
+func (n *Repeat) write(b *strings.Builder) {
+	writeAtom(b, n.Sub)
+	switch {
+	case n.Min == 0 && n.Max == -1:
+		b.WriteRune('*')
+	case n.Min == 1 && n.Max == -1:
+		b.WriteRune('+')
+	case n.Min == 0 && n.Max == 1:
+		b.WriteRune('?')
+	case n.Max == -1:
+		b.WriteString("{" + strconv.Itoa(n.Min) + ",}")
+	case n.Min == n.Max:
+		b.WriteString("{" + strconv.Itoa(n.Min) + "}")
+	default:
+		b.WriteString("{" + strconv.Itoa(n.Min) + "," + strconv.Itoa(n.Max) + "}")
+	}
+	if !n.Greedy {
+		b.WriteRune('?')
+	}
+}
+
+func (n *Capture) write(b *strings.Builder) {
+	if n.Name != "" {
+		b.WriteString("(?P<" + n.Name + ">")
+	} else {
+		b.WriteRune('(')
+	}
+	n.Sub.write(b)
+	b.WriteRune(')')
+}
+
+func (n *Assertion) write(b *strings.Builder) {
+	switch n.Kind {
+	case BeginText:
+		b.WriteString("^")
+	case BeginLine:
+		b.WriteString("(?m:^)")
+	case EndText:
+		b.WriteString("$")
+	case EndLine:
+		b.WriteString("(?m:$)")
+	case WordBoundary:
+		b.WriteString(`\b`)
+	case NotWordBoundary:
+		b.WriteString(`\B`)
+	case UnicodeWordBoundary:
+		b.WriteString(`(?u:\b)`)
+	case NotUnicodeWordBoundary:
+		b.WriteString(`(?u:\B)`)
+	}
+}
+
+func (n *Empty) String() string     { return render(n) }
+func (n *Literal) String() string   { return render(n) }
+func (n *Class) String() string     { return render(n) }
+func (n *Concat) String() string    { return render(n) }
+func (n *Alternate) String() string { return render(n) }
+func (n *Repeat) String() string    { return render(n) }
+func (n *Capture) String() string   { return render(n) }
+func (n *Assertion) String() string { return render(n) }
+
+// Render any node into a string.
+func render(n Node) string {
+	var b strings.Builder
+	n.write(&b)
+	return b.String()
+}
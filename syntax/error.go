@@ -0,0 +1,99 @@
+package syntax
+
+// Describes the structured error returned by Parse(). Each ParseError carries
+// an ErrorCode, which itself satisfies the error interface; this allows callers
+// to test for a specific failure with errors.Is, e.g.
+//    _, err := syntax.Parse("a**")
+//    errors.Is(err, syntax.ErrMissingRepeatArgument) // true
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrorCode describes a class of failure encountered while parsing a regexp.
+type ErrorCode int
+
+// Enum-style definitions for the ErrorCode type.
+const (
+	ErrInternalError         ErrorCode = iota // unexpected failure inside sre2
+	ErrUnexpectedEOF                          // pattern ended within a term
+	ErrMissingRepeatArgument                  // repetition with nothing to repeat
+	ErrUnexpectedClose                        // unmatched ')', ']' or '}'
+	ErrMissingParen                           // '(' without matching ')'
+	ErrMissingBracket                         // '[' without matching ']'
+	ErrMissingDelimiter                       // e.g. '\Q' without '\E', or '{' without '}'
+	ErrInvalidEscape                          // unknown or malformed escape sequence
+	ErrInvalidCharClass                       // unknown named or nested class
+	ErrInvalidCharRange                       // range where high < low
+	ErrInvalidRepeatSize                      // malformed or out-of-order {n,m}
+	ErrInvalidFlag                            // unknown flag within (?...)
+	ErrDuplicateName                          // capturing group name used twice
+	ErrInvalidByte                            // rune above \xff, as per ParseBytes
+	ErrInvalidName                            // empty or non-word capturing group name
+)
+
+var errorCodeText = []string{
+	ErrInternalError:         "internal error",
+	ErrUnexpectedEOF:         "unexpected end of pattern",
+	ErrMissingRepeatArgument: "missing argument to repetition operator",
+	ErrUnexpectedClose:       "unexpected close element",
+	ErrMissingParen:          "missing closing )",
+	ErrMissingBracket:        "missing closing ]",
+	ErrMissingDelimiter:      "missing closing delimiter",
+	ErrInvalidEscape:         "invalid escape sequence",
+	ErrInvalidCharClass:      "invalid character class",
+	ErrInvalidCharRange:      "invalid character class range",
+	ErrInvalidRepeatSize:     "invalid repeat count",
+	ErrInvalidFlag:           "invalid or unknown flag",
+	ErrDuplicateName:         "duplicate capture group name",
+	ErrInvalidByte:           "invalid byte",
+	ErrInvalidName:           "invalid capture group name",
+}
+
+// String returns a human-readable description of this ErrorCode.
+func (c ErrorCode) String() string {
+	if c < 0 || int(c) >= len(errorCodeText) {
+		return fmt.Sprintf("unknown error code %d", int(c))
+	}
+	return errorCodeText[c]
+}
+
+// Error implements the error interface, so that an ErrorCode may be used as the
+// target of errors.Is.
+func (c ErrorCode) Error() string {
+	return c.String()
+}
+
+// ParseError describes a failure to parse a regexp. Offset is the byte offset
+// into Pattern where the problem begins, and Fragment is the offending part of
+// Pattern (i.e. Pattern[Offset:Offset+len(Fragment)]).
+type ParseError struct {
+	Code     ErrorCode
+	Pattern  string
+	Offset   int
+	Fragment string
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("could not parse `%s`, error: %s at offset %d: `%s`",
+		e.Pattern, e.Code, e.Offset, e.Fragment)
+}
+
+// Unwrap returns the ErrorCode of this ParseError, for use by errors.Is.
+func (e *ParseError) Unwrap() error {
+	return e.Code
+}
+
+// Snippet renders the pattern on one line, followed by a line of carets that
+// underlines the offending fragment. Columns are counted in runes.
+func (e *ParseError) Snippet() string {
+	col := utf8.RuneCountInString(e.Pattern[:e.Offset])
+	width := utf8.RuneCountInString(e.Fragment)
+	if width == 0 {
+		width = 1 // always point at something, even at EOF
+	}
+	return e.Pattern + "\n" + strings.Repeat(" ", col) + strings.Repeat("^", width)
+}
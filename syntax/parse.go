@@ -0,0 +1,548 @@
+package syntax
+
+// Describes Parse(), which reads a regexp pattern and builds its syntax tree.
+// The parser is a simple recursive descent parser, which works as follows:
+//    alt:     regexp[|regexp]...
+//    regexp:  [closure]...
+//    closure: term[repetition]
+//    term:    a bracketed alt, an assertion, a string literal or a class
+//
+// Failures panic with a *ParseError, which is recovered by Parse().
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Escape constants and their mapping to actual Unicode runes.
+var (
+	ESCAPES = map[rune]rune{
+		'a': 7, 't': 9, 'n': 10, 'v': 11, 'f': 12, 'r': 13,
+	}
+)
+
+// Flags which may be set or cleared within (?...).
+var known_flags = "imsUu"
+
+// Transient parser state, a combination of tree and pattern iterator.
+type parser struct {
+	src   reader
+	flags int64 // on/off state for flags 64-127 (subtract 64, uses bits)
+	caps  int   // number of capturing groups opened so far
+	bytes bool  // whether runes denote bytes, as per ParseBytes
+
+	names map[string]bool // names of capturing groups seen so far
+}
+
+// Determine whether the given flag is set. Requires flag in range 64-127,
+// subtracts 64 and checks for bit set in flags int64.
+func (p *parser) flag(flag int) bool {
+	if flag < 64 || flag > 127 {
+		panic(fmt.Sprintf("can't check flag, out of range: %c", flag))
+	}
+	return (p.flags & (1 << byte(flag-64))) != 0
+}
+
+// Consume some alternate regexps. That is, (regexp[|regexp][|regexp]...).
+// This method will return when it encounters an outer ')' or EOF, and the
+// cursor will rest on that character.
+func (p *parser) alt() Node {
+	// Hold onto the current set of flags; reset after.
+	old_flags := p.flags
+	defer func() {
+		p.flags = old_flags
+	}()
+
+	subs := []Node{p.regexp()}
+	for p.src.curr() == '|' {
+		p.src.nextCh()
+		subs = append(subs, p.regexp())
+	}
+
+	if len(subs) == 1 {
+		return subs[0]
+	}
+	return &Alternate{subs}
+}
+
+// Consume a single rune, as per any_rune(). If runes denote bytes, will panic
+// if the rune is above '\xff'.
+func (p *parser) single_rune() rune {
+	start := p.src.opos
+	r := p.any_rune()
+	if p.bytes && r > 0xff {
+		p.src.fail(ErrInvalidByte, start, p.src.opos)
+	}
+	return r
+}
+
+// Consume a single rune; assumes this is being invoked as the last possible
+// option and will panic if an invalid escape sequence is found. Will return the
+// found rune (as an integer) and with cursor past the entire representation.
+func (p *parser) any_rune() rune {
+	start := p.src.opos
+	if r := p.src.curr(); r != '\\' {
+		// This is just a regular character; return it immediately.
+		p.src.nextCh()
+		return r
+	}
+
+	if p.src.peek() == 'x' {
+		// Match hex character code.
+		var hex string
+		p.src.nextCh()
+		if p.src.nextCh() == '{' {
+			hex = p.src.literal("{", "}")
+		} else {
+			hex = fmt.Sprintf("%c%c", p.src.curr(), p.src.nextCh())
+			p.src.nextCh() // Step over the end of the hex code.
+		}
+
+		// Parse and return the corresponding rune.
+		raw, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || raw > unicode.MaxRune {
+			p.src.fail(ErrInvalidEscape, start, p.src.opos)
+		}
+		return rune(raw)
+	} else if r := ESCAPES[p.src.peek()]; r != 0 {
+		// Literally match '\n', '\r', etc.
+		p.src.nextCh()
+		p.src.nextCh()
+		return r
+	} else if unicode.Is(posix_groups["punct"], p.src.peek()) {
+		// Allow punctuation to be blindly escaped.
+		r := p.src.nextCh()
+		p.src.nextCh()
+		return r
+	} else if unicode.IsDigit(p.src.peek()) {
+		// Match octal character code (begins with digit, up to three digits).
+		oct := ""
+		p.src.nextCh()
+		for i := 0; i < 3; i++ {
+			oct += fmt.Sprintf("%c", p.src.curr())
+			if !unicode.IsDigit(p.src.nextCh()) {
+				break
+			}
+		}
+
+		// Parse and return the corresponding rune.
+		raw, err := strconv.ParseUint(oct, 8, 32)
+		if err != nil {
+			p.src.fail(ErrInvalidEscape, start, p.src.opos)
+		}
+		return rune(raw)
+	}
+
+	// This is an escape sequence which does not identify a single rune.
+	p.src.nextCh()
+	panic(p.src.error(ErrInvalidEscape, start, p.src.npos()))
+}
+
+// Consume a named class at the cursor, if one exists: that is, '.', an
+// ASCII/POSIX class such as '[:alpha:]', a Unicode class such as '\pN', or a
+// Perl class such as '\d'. Consumes the entire definition.
+func (p *parser) named_class() (item ClassItem, ok bool) {
+	start := p.src.opos
+	switch p.src.curr() {
+	case '.':
+		p.src.nextCh()
+		if p.flag('s') {
+			return ClassItem{Kind: ItemAnyNL}, true
+		}
+		return ClassItem{Kind: ItemAnyNotNL}, true
+	case '[':
+		if p.src.peek() == ':' {
+			// Match an ASCII/POSIX class name.
+			item = ClassItem{Kind: ItemPosix, Name: p.src.literal("[:", ":]")}
+			if strings.HasPrefix(item.Name, "^") {
+				item.Negate = true
+				item.Name = item.Name[1:]
+			}
+			if PosixGroup(item.Name) == nil {
+				p.src.fail(ErrInvalidCharClass, start, p.src.opos)
+			}
+			return item, true
+		}
+	case '\\':
+		// Match some escaped character or escaped combination.
+		if p.src.peek() == 'C' && p.bytes {
+			// Match any single byte.
+			p.src.consume("\\C")
+			return ClassItem{Kind: ItemAnyByte}, true
+		} else if p.src.peek() == 'p' || p.src.peek() == 'P' {
+			// Match a Unicode class name.
+			item = ClassItem{Kind: ItemUnicode}
+			item.Negate = (p.src.nextCh() == 'P')
+			item.Name = fmt.Sprintf("%c", p.src.nextCh())
+			if item.Name == "{" {
+				item.Name = p.src.literal("{", "}")
+			} else {
+				p.src.nextCh() // move past the single class description
+			}
+
+			if UnicodeClass(item.Name) == nil {
+				p.src.fail(ErrInvalidCharClass, start, p.src.opos)
+			}
+			return item, true
+		} else if PerlGroup(unicode.ToLower(p.src.peek())) != nil {
+			// We've found a Perl group.
+			item = ClassItem{Kind: ItemPerl}
+			item.Negate = unicode.IsUpper(p.src.nextCh())
+			item.Name = string(unicode.ToLower(p.src.curr()))
+			item.Unicode = p.flag('u')
+			p.src.nextCh()
+			return item, true
+		}
+	}
+	return item, false
+}
+
+// Consume a single character class, or a single rune literal, outside of any
+// [...] block. Consumes the entire definition.
+func (p *parser) class() Node {
+	start := p.src.opos
+	if item, ok := p.named_class(); ok {
+		fold := p.flag('i') && item.Kind != ItemAnyNotNL && item.Kind != ItemAnyNL && item.Kind != ItemAnyByte
+		return &Class{Items: []ClassItem{item}, FoldCase: fold}
+	}
+
+	if p.src.curr() == '[' {
+		// Consume and merge all valid classes within this [...] block.
+		class := &Class{Bracket: true, FoldCase: p.flag('i')}
+		if p.src.nextCh() == '^' {
+			class.Negate = true
+			p.src.nextCh()
+		}
+		for p.src.curr() != ']' {
+			if p.src.curr() == -1 {
+				p.src.fail(ErrMissingBracket, start, -1)
+			}
+			class.Items = append(class.Items, p.class_item())
+		}
+		p.src.nextCh() // Move over final ']'.
+		return class
+	}
+
+	// Match a single rune literal. Note that '-' outside a character class is
+	// treated as a literal.
+	return &Literal{[]rune{p.single_rune()}, p.flag('i')}
+}
+
+// Consume a single item within a [...] block. This may be a named class, a
+// single rune literal, or a range of runes.
+func (p *parser) class_item() ClassItem {
+	start := p.src.opos
+	if item, ok := p.named_class(); ok {
+		return item
+	}
+	if p.src.curr() == '[' {
+		p.src.fail(ErrInvalidCharClass, start, p.src.npos())
+	}
+
+	lo := p.single_rune()
+	hi := lo
+	if p.src.curr() == '-' {
+		p.src.nextCh() // move over '-'
+		hi = p.single_rune()
+		if hi < lo {
+			p.src.fail(ErrInvalidCharRange, start, p.src.opos)
+		}
+	}
+	return ClassItem{Kind: ItemRange, Lo: lo, Hi: hi}
+}
+
+// Whether the given capturing group name is valid: that is, non-empty, and made
+// only of ASCII word characters, as per '\w'.
+func validName(name string) bool {
+	for _, r := range name {
+		if !unicode.Is(perl_groups['w'], r) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Consume a single term at the current cursor position. This may include a
+// bracketed expression. When this function returns, the cursor will have moved
+// past the final rune in this term.
+func (p *parser) term() Node {
+	open := p.src.opos
+	switch p.src.curr() {
+	case -1:
+		p.src.fail(ErrUnexpectedEOF, open, -1)
+	case '*', '+', '{', '?':
+		p.src.fail(ErrMissingRepeatArgument, open, p.src.npos())
+	case ')', '}', ']':
+		p.src.fail(ErrUnexpectedClose, open, p.src.npos())
+	case '(':
+		// Match a bracketed expression (or modify current flags, with '?').
+		capture := true
+		alt_id := ""
+		old_flags := p.flags
+		if p.src.nextCh() == '?' {
+			// Do something interesting before descending into this alt.
+			p.src.nextCh()
+			if p.src.curr() == 'P' {
+				p.src.nextCh() // move to '<'
+				alt_id = p.src.literal("<", ">")
+				if !validName(alt_id) {
+					p.src.fail(ErrInvalidName, open, p.src.opos)
+				} else if p.names[alt_id] {
+					p.src.fail(ErrDuplicateName, open, p.src.opos)
+				}
+				p.names[alt_id] = true
+			} else {
+				// anything but 'P' means flags (and, non-captured).
+				capture = false
+				set := true
+			outer:
+				for {
+					switch p.src.curr() {
+					case ':':
+						p.src.nextCh() // move past ':'
+						break outer    // no more flags, process re
+					case ')':
+						// Return immediately: there's no term here, just flag sets!
+						p.src.nextCh()
+						return &Empty{}
+					case '-':
+						// now we're clearing flags
+						set = false
+					case -1:
+						p.src.fail(ErrMissingParen, open, -1)
+					default:
+						if !strings.ContainsRune(known_flags, p.src.curr()) {
+							p.src.fail(ErrInvalidFlag, p.src.opos, p.src.npos())
+						}
+						flag := byte(p.src.curr() - 64)
+						if set {
+							p.flags |= (1 << flag)
+						} else {
+							p.flags &= ^(1 << flag)
+						}
+					}
+					p.src.nextCh()
+				}
+			}
+		}
+
+		// Now actually consume the bracketed expression. Capturing groups are
+		// numbered in order of their opening bracket.
+		var index int
+		if capture {
+			p.caps += 1
+			index = p.caps
+		}
+		sub := p.alt()
+		if p.src.curr() != ')' {
+			p.src.fail(ErrMissingParen, open, -1)
+		}
+		p.src.nextCh()
+		p.flags = old_flags
+		if capture {
+			return &Capture{sub, index, alt_id}
+		}
+		return sub
+	case '$':
+		// Match the end of text, or (with 'm') the end of a line.
+		p.src.nextCh() // consume '$'
+		if p.flag('m') {
+			return &Assertion{EndLine}
+		}
+		return &Assertion{EndText}
+	case '^':
+		// Match the beginning of text, or (with 'm') the start of a line.
+		p.src.nextCh() // consume '^'
+		if p.flag('m') {
+			return &Assertion{BeginLine}
+		}
+		return &Assertion{BeginText}
+	case '\\':
+		// Peek forward to match backslash-escaped terms which are not character
+		// classes. If any of these branches trigger, they will return past the
+		// consumed 'term'.
+		switch p.src.peek() {
+		case 'Q':
+			// Match a complete string literal, contained between '\Q' and the nearest
+			// '\E'. Use p.src.literal() since we're not interested in interpreting any
+			// unique characters, such as e.g. \x00 or \] (punct).
+			start := p.src.opos
+			literal := p.src.literal("\\Q", "\\E")
+			if len(literal) == 0 {
+				return &Empty{}
+			}
+			runes := []rune(literal)
+			if p.bytes && slices.Max(runes) > 0xff {
+				p.src.fail(ErrInvalidByte, start, p.src.opos)
+			}
+			return &Literal{runes, p.flag('i')}
+		case 'A':
+			// Match only the beginning of text.
+			p.src.consume("\\A")
+			return &Assertion{BeginText}
+		case 'z':
+			// Match only the end of text.
+			p.src.consume("\\z")
+			return &Assertion{EndText}
+		case 'b':
+			// Match a word boundary, of Unicode words if 'u' is flagged.
+			p.src.consume("\\b")
+			if p.flag('u') {
+				return &Assertion{UnicodeWordBoundary}
+			}
+			return &Assertion{WordBoundary}
+		case 'B':
+			// Match anywhere but a word boundary, of Unicode words if 'u' is flagged.
+			p.src.consume("\\B")
+			if p.flag('u') {
+				return &Assertion{NotUnicodeWordBoundary}
+			}
+			return &Assertion{NotWordBoundary}
+		}
+	}
+
+	// Try to consume a rune class.
+	return p.class()
+}
+
+// Consume a closure, defined as (term[repitition]). When this function returns,
+// the cursor will be resting past the final rune in this closure.
+func (p *parser) closure() Node {
+	start := p.src.opos
+	t := p.term()
+
+	// Min and max represent the number of required cases, and the total number
+	// of cases, respectively. Max may be -1 to indicate no limit.
+	var min int
+	var max int
+
+	// By default, greedily choose an optional step over continuing. If 'U' is
+	// flagged, swap this behaviour.
+	greedy := true
+	if p.flag('U') {
+		greedy = false
+	}
+	switch p.src.curr() {
+	case '?':
+		p.src.nextCh()
+		min, max = 0, 1
+	case '*':
+		p.src.nextCh()
+		min, max = 0, -1
+	case '+':
+		p.src.nextCh()
+		min, max = 1, -1
+	case '{':
+		open := p.src.opos
+		raw := p.src.literal("{", "}")
+		parts := strings.SplitN(raw, ",", 2)
+		var err error
+		if min, err = strconv.Atoi(parts[0]); err != nil {
+			p.src.fail(ErrInvalidRepeatSize, open, p.src.opos)
+		}
+		max = min
+		if len(parts) == 2 {
+			if len(parts[1]) > 0 {
+				if max, err = strconv.Atoi(parts[1]); err != nil {
+					p.src.fail(ErrInvalidRepeatSize, open, p.src.opos)
+				}
+				// {n,x} means: between n and x matches.
+				if max < min {
+					p.src.fail(ErrInvalidRepeatSize, open, p.src.opos)
+				}
+			} else {
+				max = -1
+			}
+		}
+	default:
+		return t // nothing to see here
+	}
+
+	if p.src.curr() == '?' {
+		greedy = !greedy
+		p.src.nextCh()
+	}
+
+	if min < 0 || max == 0 {
+		p.src.fail(ErrInvalidRepeatSize, start, p.src.opos)
+	}
+	return &Repeat{t, min, max, greedy}
+}
+
+// Match a regexp (defined as ([closure]*)) from the parser until either: EOF,
+// the literal '|' or the literal ')'. At return, the cursor will still rest
+// on this final terminal character.
+func (p *parser) regexp() Node {
+	var subs []Node
+	for {
+		if p.src.curr() == -1 || p.src.curr() == '|' || p.src.curr() == ')' {
+			break
+		}
+		sub := p.closure()
+		if _, ok := sub.(*Empty); ok {
+			continue // e.g. flag sets, which have no effect on the tree
+		}
+
+		// Merge adjacent literals of the same case sensitivity.
+		if lit, ok := sub.(*Literal); ok && len(subs) != 0 {
+			if prev, ok := subs[len(subs)-1].(*Literal); ok && prev.FoldCase == lit.FoldCase {
+				prev.Runes = append(prev.Runes, lit.Runes...)
+				continue
+			}
+		}
+		subs = append(subs, sub)
+	}
+
+	switch len(subs) {
+	case 0:
+		return &Empty{}
+	case 1:
+		return subs[0]
+	}
+	return &Concat{subs}
+}
+
+// Parse builds the syntax tree of the given regexp pattern. If the pattern could
+// not be parsed, returns a non-nil *ParseError: the tree will be nil in this
+// case.
+func Parse(src string) (re Node, err error) {
+	return parse(src, false)
+}
+
+// ParseBytes is as Parse, but for patterns which match bytes rather than runes.
+// Each rune of the pattern, which may be at most '\xff', denotes the byte of
+// the same value: that is, the pattern is read as Latin-1. Additionally, '\C'
+// matches any single byte.
+func ParseBytes(src string) (re Node, err error) {
+	return parse(src, true)
+}
+
+// Parse the given pattern, with runes denoting bytes if bytes is set.
+func parse(src string, bytes bool) (re Node, err error) {
+	p := parser{src: newReader(src), names: make(map[string]bool), bytes: bytes}
+
+	defer func() {
+		if r := recover(); r != nil {
+			re = nil // clear re so it can't be used by caller
+			switch x := r.(type) {
+			case *ParseError:
+				err = x
+			case string:
+				// Internal failure; report it against the current cursor.
+				err = p.src.error(ErrInternalError, p.src.opos, p.src.npos())
+			default:
+				panic(fmt.Sprint("unknown parse error: ", r))
+			}
+		}
+	}()
+
+	p.src.nextCh()
+	re = p.alt()
+	if p.src.curr() != -1 {
+		p.src.fail(ErrUnexpectedClose, p.src.opos, p.src.npos())
+	}
+	return re, nil
+}
@@ -0,0 +1,121 @@
+package syntax
+
+// Describes the pattern reader used by the parser. Notably, allows the parser
+// to examine the current rune, peek at the next rune, consume literals between
+// prefix/suffix, and rebase the cursor in an absolute fashion within the
+// pattern. On instantiation, this reader is focused 'before' the initial
+// string: calling curr() will return -1, and peek() will return the first rune.
+//
+// Failures are reported by panicking with a *ParseError, via fail(); these are
+// recovered by Parse().
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type reader struct {
+	str  string // backing string
+	ch   rune   // current ch
+	opos int    // previous (absolute) position in str, before ch
+	pos  int    // current (absolute) position in str, after ch
+}
+
+func newReader(str string) reader {
+	return reader{str, -1, -1, 0}
+}
+
+// Absolute position after the current character, inside reader. This will
+// be -1 if EOF.
+func (r *reader) npos() int {
+	return r.pos
+}
+
+// Returns the current focus rune in reader. This will be -1 if EOF or if
+// nextCh() has not yet been called.
+func (r *reader) curr() rune {
+	return r.ch
+}
+
+// Peek at the next focus rune in reader.
+func (r *reader) peek() rune {
+	if r.pos >= 0 && r.pos < len(r.str) {
+		r, _ := utf8.DecodeRuneInString(r.str[r.pos:])
+		return r
+	}
+	return -1
+}
+
+// Move forward, and return the next rune. This will return -1 if the string is
+// at EOF.
+func (r *reader) nextCh() rune {
+	if r.pos >= 0 && r.pos < len(r.str) {
+		rune, size := utf8.DecodeRuneInString(r.str[r.pos:])
+		r.ch = rune
+		r.opos = r.pos
+		r.pos += size
+	} else {
+		r.ch = -1
+		r.opos = len(r.str)
+		r.pos = -1
+	}
+	return r.ch
+}
+
+// Refocus the parser at a given point within the parsed string. When this method
+// returns, the current focus rune will be directly after the given index.
+func (r *reader) jump(to int) {
+	r.pos = to
+	r.nextCh()
+}
+
+// Consume a known literal at the given point. If the literal does not exist,
+// starting with the current focus rune, then panic with a *ParseError.
+func (r *reader) consume(str string) {
+	if r.opos == -1 {
+		panic("can't consume before reading")
+	}
+	if !strings.HasPrefix(r.str[r.opos:], str) {
+		r.fail(ErrMissingDelimiter, r.opos, r.pos)
+	}
+	r.jump(r.opos + len(str))
+}
+
+// Consume a literal that *must* exist, between the given prefix and suffix.
+// Searches for the prefix starting with the current focus rune, and returns
+// this reader focused on the rune directly after the suffix.
+// e.g. "abcde\Qhello\Eblah", with literal("\\Q", "\\E"), returns "hello"
+//    focus --^                         and will focus on "b" after "\E".
+func (r *reader) literal(prefix string, suffix string) string {
+	r.consume(prefix)
+	start := r.opos
+
+	idx := strings.Index(r.str[r.opos:], suffix)
+	if idx == -1 {
+		r.fail(ErrMissingDelimiter, start-len(prefix), len(r.str))
+	}
+	r.jump(r.opos + idx + len(suffix))
+
+	return r.str[start : start+idx]
+}
+
+// Build a *ParseError of the given code, describing the source between start
+// and end. An end of -1 (i.e. EOF) or beyond the source is clamped to its
+// length.
+func (r *reader) error(code ErrorCode, start int, end int) *ParseError {
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end > len(r.str) {
+		end = len(r.str)
+	}
+	if end < start {
+		end = start
+	}
+	return &ParseError{code, r.str, start, r.str[start:end]}
+}
+
+// Abort parsing by panicking with a *ParseError, as per error().
+func (r *reader) fail(code ErrorCode, start int, end int) {
+	panic(r.error(code, start, end))
+}
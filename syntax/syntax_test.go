@@ -0,0 +1,180 @@
+package syntax
+
+import (
+	"errors"
+	"testing"
+)
+
+// Test the reader used by the parser.
+func TestReader(t *testing.T) {
+	src := newReader("a{bc}d")
+
+	if src.curr() != -1 {
+		t.Error("should not yet be parsing")
+	}
+	if src.nextCh() != 'a' || src.nextCh() != '{' {
+		t.Error("should read a{")
+	}
+	if lit := src.literal("{", "}"); lit != "bc" {
+		t.Error("should equal contained value, got: " + lit)
+	}
+	if src.curr() != 'd' {
+		t.Error("should now rest on d")
+	}
+	if src.nextCh() != -1 {
+		t.Error("should be done now")
+	}
+}
+
+// Test the shape of parsed trees.
+func TestParseTree(t *testing.T) {
+	re, err := Parse(`^(?P<word>\w+)|x(?i:ab)*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt, ok := re.(*Alternate)
+	if !ok || len(alt.Subs) != 2 {
+		t.Fatalf("expected top-level alternate, got %#v", re)
+	}
+
+	first := alt.Subs[0].(*Concat)
+	if a, ok := first.Subs[0].(*Assertion); !ok || a.Kind != BeginText {
+		t.Errorf("expected begin text assertion, got %#v", first.Subs[0])
+	}
+	c, ok := first.Subs[1].(*Capture)
+	if !ok || c.Index != 1 || c.Name != "word" {
+		t.Fatalf("expected named capture, got %#v", first.Subs[1])
+	}
+	rep := c.Sub.(*Repeat)
+	if rep.Min != 1 || rep.Max != -1 || !rep.Greedy {
+		t.Errorf("expected greedy +, got %#v", rep)
+	}
+	class := rep.Sub.(*Class)
+	if class.Bracket || class.Items[0].Kind != ItemPerl || class.Items[0].Name != "w" {
+		t.Errorf("expected \\w, got %#v", class)
+	}
+
+	second := alt.Subs[1].(*Concat)
+	if lit := second.Subs[0].(*Literal); string(lit.Runes) != "x" || lit.FoldCase {
+		t.Errorf("expected case-sensitive x, got %#v", lit)
+	}
+	rep = second.Subs[1].(*Repeat)
+	if lit := rep.Sub.(*Literal); string(lit.Runes) != "ab" || !lit.FoldCase {
+		t.Errorf("expected merged case-insensitive ab, got %#v", lit)
+	}
+
+	// Captures are numbered by their opening bracket, and flags do not escape.
+	re, _ = Parse(`((a)(?U)b*)(c)?`)
+	var indexes []int
+	Walk(re, func(n Node) bool {
+		if c, ok := n.(*Capture); ok {
+			indexes = append(indexes, c.Index)
+		}
+		if r, ok := n.(*Repeat); ok {
+			if _, lit := r.Sub.(*Literal); lit && r.Greedy {
+				t.Error("b* should be ungreedy")
+			}
+		}
+		return true
+	})
+	if len(indexes) != 3 || indexes[0] != 1 || indexes[1] != 2 || indexes[2] != 3 {
+		t.Errorf("unexpected capture order: %v", indexes)
+	}
+}
+
+// Test that trees are rendered back into equivalent patterns.
+func TestString(t *testing.T) {
+	cases := []struct {
+		src, expected string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"a|b|", "a|b|"},
+		{"(a|b)c", "(a|b)c"},
+		{"(?:a|b)c", "(?:a|b)c"},
+		{"ab*c+?d{2}e{2,}f{2,3}", "ab*c+?d{2}e{2,}f{2,3}"},
+		{"(?:ab)*", "(?:ab)*"},
+		{"(?U)a*b*?", "a*?b*"},
+		{"(?i)ab(?-i)c", "(?i:ab)c"},
+		{"(?m)^a$", "(?m:^)a(?m:$)"},
+		{`\Aa\z\b\B`, `^a$\b\B`},
+		{`\Q.*\E`, `\.\*`},
+		{`[^a-z\d.\]\.]`, `[^a-z\d.\]\.]`},
+		{`[[:^alpha:]\PN\p{Greek}]`, `[[:^alpha:]\PN\p{Greek}]`},
+		{`(?s).`, `(?s:.)`},
+		{`\x{263a}\t\x00`, "☺\\t\\x{0}"},
+		{`(?P<name>x)`, `(?P<name>x)`},
+		{`(?u)\b\w[\d.]\B(?-u)\s`, `(?u:\b)(?u:\w)(?u:[\d.])(?u:\B)\s`},
+		{`(?ui)\w`, `(?u:(?i:\w))`},
+	}
+	for _, c := range cases {
+		re, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.src, err)
+			continue
+		}
+		out := re.String()
+		if out != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, out)
+		}
+
+		// The rendered pattern must itself parse to the same rendering.
+		again, err := Parse(out)
+		if err != nil {
+			t.Errorf("%q: rendered %q does not parse: %v", c.src, out, err)
+		} else if again.String() != out {
+			t.Errorf("%q: rendered %q is not stable, got %q", c.src, out, again.String())
+		}
+	}
+}
+
+// Test that errors are returned as a *ParseError.
+func TestParseError(t *testing.T) {
+	re, err := Parse("a(b")
+	var perr *ParseError
+	if re != nil || !errors.As(err, &perr) || perr.Code != ErrMissingParen || perr.Offset != 1 {
+		t.Errorf("expected missing paren at 1, got %v", err)
+	}
+
+	_, err = Parse("(?P<a>x)|(?P<a>y)")
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("expected duplicate name, got %v", err)
+	}
+
+	for _, src := range []string{"(?P<>x)", "(?P<a b>x)", "(?P<é>x)"} {
+		if _, err = Parse(src); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: expected invalid name, got %v", src, err)
+		}
+	}
+	if _, err = Parse("(?P<a_1>x)"); err != nil {
+		t.Errorf("expected valid name, got %v", err)
+	}
+}
+
+// Test that ParseBytes accepts '\C', and only runes which denote bytes.
+func TestParseBytes(t *testing.T) {
+	re, err := ParseBytes(`\xe9\C[\x80-\xff]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := re.String(); out != "é\\C[\\x{80}-ÿ]" {
+		t.Errorf("unexpected rendering: %q", out)
+	}
+	if _, err := Parse(`\C`); !errors.Is(err, ErrInvalidEscape) {
+		t.Errorf("expected invalid escape outside of byte mode, got %v", err)
+	}
+
+	invalid := map[string]string{
+		"a☺":          "☺",
+		`\x{100}`:     `\x{100}`,
+		`[a-\x{100}]`: `\x{100}`,
+		`x\Q☺\E`:      `\Q☺\E`,
+	}
+	for src, fragment := range invalid {
+		_, err := ParseBytes(src)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Code != ErrInvalidByte || perr.Fragment != fragment {
+			t.Errorf("%q: expected invalid byte at %q, got %v", src, fragment, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package syntax
+
+// This file describes ASCII character ranges as per "Perl character classes"
+// and "ASCII character classes" (POSIX) on the RE2 syntax page, found here:
+// http://code.google.com/p/re2/wiki/Syntax
+
+import "unicode"
+
+var posix_groups = map[string]*unicode.RangeTable{
+	"alnum": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'0', '9', 1},
+			{'A', 'Z', 1},
+			{'a', 'z', 1},
+		},
+	},
+	"alpha": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'A', 'Z', 1},
+			{'a', 'z', 1},
+		},
+	},
+	"ascii": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{0x00, 0x7f, 1},
+		},
+	},
+	"blank": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'\t', '\t', 1},
+			{' ', ' ', 1},
+		},
+	},
+	"cntrl": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{0x00, 0x1f, 1},
+			{0x7f, 0x7f, 1},
+		},
+	},
+	"digit": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'0', '9', 1},
+		},
+	},
+	"graph": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'!', '~', 1},
+		},
+	},
+	"lower": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'a', 'z', 1},
+		},
+	},
+	"print": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{' ', '~', 1},
+		},
+	},
+	"punct": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'!', '/', 1},
+			{':', '@', 1},
+			{'[', '`', 1},
+			{'{', '~', 1},
+		},
+	},
+	"space": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'\t', '\r', 1},
+			{' ', ' ', 1},
+		},
+	},
+	"upper": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'A', 'Z', 1},
+		},
+	},
+	"word": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'0', '9', 1},
+			{'A', 'Z', 1},
+			{'_', '_', 1},
+			{'a', 'z', 1},
+		},
+	},
+	"xdigit": &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'0', '9', 1},
+			{'A', 'F', 1},
+			{'a', 'f', 1},
+		},
+	},
+}
+
+var perl_groups = map[rune]*unicode.RangeTable{
+	'd': posix_groups["digit"],
+	'w': posix_groups["word"],
+	's': &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{'\t', '\n', 1},
+			{'\f', '\r', 1},
+			{' ', ' ', 1},
+		},
+	},
+}
+
+// Unicode definitions of the Perl classes, as used with (?u): decimal digits,
+// white space, and the runes of words (letters, marks, decimal digits and
+// connector punctuation such as '_').
+var unicode_perl_groups = map[rune][]*unicode.RangeTable{
+	'd': {unicode.Nd},
+	'w': {unicode.L, unicode.M, unicode.Nd, unicode.Pc},
+	's': {unicode.White_Space},
+}
+
+// PosixGroup returns the table for the named ASCII/POSIX class (e.g. "alpha"),
+// or nil if no such class exists.
+func PosixGroup(name string) *unicode.RangeTable {
+	return posix_groups[name]
+}
+
+// PerlGroup returns the table for the Perl class identified by its lowercase
+// rune (one of 'd', 'w' or 's'), or nil if no such class exists.
+func PerlGroup(r rune) *unicode.RangeTable {
+	return perl_groups[r]
+}
+
+// UnicodePerlGroup returns the tables for the Unicode definition of the Perl
+// class identified by its lowercase rune, as per PerlGroup, or nil if no such
+// class exists.
+func UnicodePerlGroup(r rune) []*unicode.RangeTable {
+	return unicode_perl_groups[r]
+}
+
+// UnicodeClass returns the tables matching a valid Unicode class. If no
+// matching classes are found, then this method will return nil.
+// Note that if just a single character is given, Categories will be searched
+// for this as a prefix (so that 'N' will match 'Nd', 'Nl', 'No' etc).
+func UnicodeClass(class string) []*unicode.RangeTable {
+	var match []*unicode.RangeTable
+	if len(class) == 1 {
+		// A single character is a shorthand request for any category starting with this.
+		for key, r := range unicode.Categories {
+			if key[0] == class[0] {
+				match = append(match, r)
+			}
+		}
+	} else {
+		// Search for the unicode class name inside cats/props/scripts.
+		options := []map[string]*unicode.RangeTable{
+			unicode.Categories, unicode.Properties, unicode.Scripts}
+		for _, option := range options {
+			if r, ok := option[class]; ok {
+				match = append(match, r)
+			}
+		}
+	}
+	return match
+}
@@ -26,7 +26,7 @@ echo
 
 # July 2011: on 2.13ghz Core 2 Duo: ~2.00
 # October 2013: on 2.66ghz Intel Core i5: ~1.92
-echo "==sre2 submatch (slow, abuse of gc for states)"
+echo "==sre2 submatch (slower, copies submatches between states)"
 time -p $CMD -sub #2>/dev/null >/dev/null
 echo
 